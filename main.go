@@ -8,11 +8,17 @@ https://wiki.theory.org/BitTorrentSpecification#Metainfo_File_Structure
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
 
 	"github.com/TatuMon/bittorrent-client/logger"
+	"github.com/TatuMon/bittorrent-client/src/dht"
+	"github.com/TatuMon/bittorrent-client/src/p2p"
 	"github.com/TatuMon/bittorrent-client/src/pieces"
 	"github.com/TatuMon/bittorrent-client/src/torrent"
 )
@@ -24,6 +30,11 @@ type ArgsAndOptions struct {
 	ShowPreview bool
 	OutputFile  string
 	TorrentFile string
+	Seed        bool
+	Port        uint
+	DHT         bool
+	DHTNodes    string
+	LSD         bool
 }
 
 func setupFlags() ArgsAndOptions {
@@ -31,10 +42,15 @@ func setupFlags() ArgsAndOptions {
 	logSentMsgs := flag.Bool("sent-msg", false, "if debug is enabled, logs sent messages")
 	logRecvMsgs := flag.Bool("recv-msg", false, "if debug is enabled, logs received messages")
 	showTorrentPreview := flag.Bool("preview", false, "prints the information about the .torrent, without downloading anything")
-	outFile := flag.String("output", "", "specify where to write the downloaded content. defaults to the name specified in the torrent file")
-	
+	outFile := flag.String("output", "", "specify where to write the downloaded content. for multi-file torrents it's the directory containing the files. defaults to the name specified in the torrent file")
+	seed := flag.Bool("seed", false, "keep uploading to peers after the download finishes, until interrupted")
+	port := flag.Uint("port", p2p.DefaultListenPort, "port to accept incoming peers on")
+	useDHT := flag.Bool("dht", true, "look for peers in the mainline DHT, besides the trackers")
+	useLSD := flag.Bool("lsd", true, "look for peers on the local network, with multicast announces")
+	dhtNodes := flag.String("dht-nodes", "", "comma separated 'host:port' of extra DHT nodes to join the DHT through, like the ones of a private swarm")
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS...] <TORRENT>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS...] <TORRENT|MAGNET>\n\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, "Options:")
 		flag.PrintDefaults()
 	}
@@ -50,13 +66,74 @@ func setupFlags() ArgsAndOptions {
 		ShowPreview: *showTorrentPreview,
 		OutputFile:  *outFile,
 		TorrentFile: torrentPath,
+		Seed:        *seed,
+		Port:        *port,
+		DHT:         *useDHT,
+		DHTNodes:    *dhtNodes,
+		LSD:         *useLSD,
+	}
+}
+
+func parseDHTNodes(arg string) ([]string, error) {
+	nodes := make([]string, 0)
+	for _, node := range strings.Split(arg, ",") {
+		node = strings.TrimSpace(node)
+		if node == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return nil, fmt.Errorf("'%s' is not 'host:port'", node)
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+/*
+Magnets also return the peers their metadata was looked up among, to start the download with them
+*/
+func getTorrent(torrentArg string, findPeers p2p.PeerFinder, ctx context.Context) (*torrent.Torrent, []p2p.Peer, error) {
+	if !torrent.IsMagnetURI(torrentArg) {
+		torr, err := torrent.TorrentFromFile(torrentArg)
+		return torr, nil, err
+	}
+
+	magnet, err := torrent.ParseMagnet(torrentArg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+
+	return p2p.TorrentFromMagnet(magnet, findPeers, ctx)
+}
+
+/*
+The DHT listens on the same port number as the peers, over UDP, as other clients do
+*/
+func startDHT(argsAndOptions ArgsAndOptions, nodes []string) *dht.Node {
+	if !argsAndOptions.DHT {
+		return nil
 	}
+
+	node, err := dht.New(dht.Config{
+		Port:      uint16(argsAndOptions.Port),
+		CachePath: dht.DefaultCachePath(),
+		Bootstrap: dht.DefaultBootstrapNodes,
+		Nodes:     nodes,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to join the DHT: %s\n", err.Error())
+		return nil
+	}
+
+	return node
 }
 
 func main() {
 	argsAndOptions := setupFlags()
 	if argsAndOptions.TorrentFile == "" {
-		fmt.Fprintf(os.Stderr, "must provide torrent file\n")
+		fmt.Fprintf(os.Stderr, "must provide torrent file or magnet link\n")
 		os.Exit(1)
 	}
 
@@ -69,12 +146,49 @@ func main() {
 		os.Exit(1)
 	}
 
-	torr, err := torrent.TorrentFromFile(argsAndOptions.TorrentFile)
+	// Interrupting stops the download gracefully, letting the trackers know we are leaving
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if argsAndOptions.Port > 65535 {
+		fmt.Fprintf(os.Stderr, "invalid port %d\n", argsAndOptions.Port)
+		os.Exit(1)
+	}
+
+	dhtNodes, err := parseDHTNodes(argsAndOptions.DHTNodes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid DHT nodes: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Started before getting the torrent, as magnets may only be found through the DHT. Previews only read the
+	// torrent, so they don't join it
+	var node *dht.Node
+	if !argsAndOptions.ShowPreview {
+		node = startDHT(argsAndOptions, dhtNodes)
+	}
+	var findPeers p2p.PeerFinder
+	if node != nil {
+		defer node.Close()
+		findPeers = node.FindPeers
+	}
+
+	torr, peers, err := getTorrent(argsAndOptions.TorrentFile, findPeers, ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to get torrent info: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	if node != nil {
+		if torr.Private {
+			// Peers of private torrents must only come from their trackers (BEP 27)
+			node.Close()
+			node = nil
+		} else {
+			node.AddBootstrapNodes(torr.Nodes...)
+		}
+	}
+
 	if argsAndOptions.ShowPreview {
 		s, err := torr.JsonPreviewIndented()
 		if err != nil {
@@ -91,7 +205,15 @@ func main() {
 		of = argsAndOptions.OutputFile
 	}
 
-	if err := pieces.StartDownload(torr, of); err != nil {
+	opts := pieces.DownloadOptions{
+		Seed:  argsAndOptions.Seed,
+		Port:  uint16(argsAndOptions.Port),
+		DHT:   node,
+		LSD:   argsAndOptions.LSD,
+		Peers: peers,
+	}
+
+	if err := pieces.StartDownload(torr, of, opts, ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to download: %s\n", err.Error())
 		os.Exit(1)
 	}
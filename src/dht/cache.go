@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Most nodes saved to the cache
+const maxCachedNodes = 200
+
+/*
+nodeCache is what's saved between runs: our ID, so other nodes recognize us, and the nodes we knew,
+so we don't depend on the bootstrap routers
+*/
+type nodeCache struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"` // In compact form
+}
+
+/*
+Where the node cache is kept by default, inside the user's cache directory
+*/
+func DefaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "bittorrent-client", "dht.dat")
+}
+
+/*
+Returns nil if there's no cache yet
+*/
+func loadCache(path string) (*nodeCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open node cache: %w", err)
+	}
+	defer f.Close()
+
+	cache := nodeCache{}
+	if err := bencode.Unmarshal(f, &cache); err != nil {
+		return nil, fmt.Errorf("failed to parse node cache: %w", err)
+	}
+
+	return &cache, nil
+}
+
+/*
+Writes our ID and the closest nodes we know to the cache, replacing it at once so it's never left half written
+*/
+func (n *Node) saveCache() error {
+	if n.config.CachePath == "" {
+		return nil
+	}
+
+	nodes := n.table.closest(n.id, maxCachedNodes)
+	if len(nodes) == 0 {
+		// Better keep the nodes from the last run
+		return nil
+	}
+
+	cache := nodeCache{
+		ID:    string(n.id[:]),
+		Nodes: string(compactNodes(nodes)),
+	}
+
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, cache); err != nil {
+		return fmt.Errorf("failed to marshal node cache: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(n.config.CachePath), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp := n.config.CachePath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write node cache: %w", err)
+	}
+
+	if err := os.Rename(tmp, n.config.CachePath); err != nil {
+		return fmt.Errorf("failed to replace node cache: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,460 @@
+/*
+Package dht implements a node of the mainline DHT (BEP 5), a Kademlia distributed hash table where
+peers of every torrent can be found without trackers.
+
+Every node has a random 160 bits ID, and keeps the peers announced for the info hashes closest to it.
+Finding the peers of a torrent means asking nodes closer and closer to its info hash, until the closest
+ones answer with the peers they know.
+
+https://www.bittorrent.org/beps/bep_0005.html
+*/
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/sirupsen/logrus"
+)
+
+// How often buckets are refreshed, expired peers forgotten, and the node cache saved
+const refreshInterval = 15 * time.Minute
+
+// How often we look for peers and announce ourselves. Nodes forget announced peers after 30 minutes
+const announceInterval = 15 * time.Minute
+
+// Wait before trying again when no node answers
+const bootstrapRetryInterval = time.Minute
+
+/*
+Public routers, only used to join the DHT when we don't know any other node
+*/
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	Port      uint16   // UDP port to listen on. 0 picks any free one
+	CachePath string   // File the known nodes are saved to, to join faster next time. Empty to not save them
+	Bootstrap []string // "host:port" of nodes to join the DHT through, when the cache has none
+	Nodes     []string // "host:port" of nodes always added on bootstrap, like the ones listed in a torrent
+}
+
+type pendingQuery struct {
+	addr   *net.UDPAddr
+	answer chan *krpcMsg
+}
+
+/*
+Node is our node in the DHT. It answers the queries of other nodes in the background, until closed.
+*/
+type Node struct {
+	id     nodeID
+	conn   *net.UDPConn
+	config Config
+	table  *routingTable
+	tokens *tokenManager
+	peers  *peerStore
+
+	mu      sync.Mutex
+	nextTx  uint16
+	pending map[string]pendingQuery // Queries waiting for an answer, by transaction ID
+
+	ctx       context.Context // Done once the node is closed
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+/*
+Starts listening for other nodes. The ID and the nodes known from the last run are loaded from the cache
+*/
+func New(config Config) (*Node, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(config.Port)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP port %d: %w", config.Port, err)
+	}
+
+	cache, err := loadCache(config.CachePath)
+	if err != nil {
+		logrus.Warnf("failed to load DHT node cache: %s", err.Error())
+	}
+
+	id := randomNodeID()
+	if cache != nil && len(cache.ID) == len(id) {
+		copy(id[:], cache.ID)
+	}
+
+	n := &Node{
+		id:      id,
+		conn:    conn,
+		config:  config,
+		table:   newRoutingTable(id),
+		tokens:  newTokenManager(),
+		peers:   newPeerStore(),
+		pending: make(map[string]pendingQuery),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	if cache != nil {
+		nodes, err := parseCompactNodes([]byte(cache.Nodes))
+		if err != nil {
+			logrus.Warnf("ignoring DHT node cache: %s", err.Error())
+		}
+		for _, c := range nodes {
+			n.table.seen(c.id, c.addr)
+		}
+	}
+
+	go n.readLoop()
+	go n.refreshLoop()
+
+	return n, nil
+}
+
+/*
+Address other nodes reach us on
+*/
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+/*
+Saves the known nodes to the cache and stops answering queries
+*/
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		if saveErr := n.saveCache(); saveErr != nil {
+			logrus.Warnf("failed to save DHT node cache: %s", saveErr.Error())
+		}
+		n.cancel()
+		err = n.conn.Close()
+	})
+
+	return err
+}
+
+func (n *Node) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return
+			}
+
+			logrus.Debugf("failed to read from DHT socket: %s", err.Error())
+			continue
+		}
+
+		m, err := parseKRPC(buf[:size])
+		if err != nil {
+			logrus.Debugf("invalid DHT message from %s: %s", addr.String(), err.Error())
+			continue
+		}
+
+		if m.Y == "q" {
+			n.handleQuery(m, addr)
+		} else {
+			n.handleAnswer(m, addr)
+		}
+	}
+}
+
+/*
+Adds the node to the routing table. If its bucket is full of nodes, the one quiet for the longest is pinged,
+and replaced if it doesn't answer
+*/
+func (n *Node) nodeSeen(id nodeID, addr *net.UDPAddr) {
+	stale := n.table.seen(id, addr)
+	if stale == nil {
+		return
+	}
+
+	go func() {
+		if _, err := n.query(n.ctx, stale.addr, "ping", krpcArgs{}); err != nil {
+			n.table.failed(stale.id)
+			n.table.replace(stale.id, &contact{id: id, addr: addr})
+		}
+	}()
+}
+
+func (n *Node) handleQuery(m *krpcMsg, addr *net.UDPAddr) {
+	var id nodeID
+	copy(id[:], m.A.ID)
+	n.nodeSeen(id, addr)
+
+	res := krpcArgs{ID: string(n.id[:])}
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		if len(m.A.Target) != 20 {
+			n.replyError(m, errProtocol, "invalid target", addr)
+			return
+		}
+
+		var target nodeID
+		copy(target[:], m.A.Target)
+		res.Nodes = string(compactNodes(n.table.closest(target, bucketSize)))
+	case "get_peers":
+		if len(m.A.InfoHash) != 20 {
+			n.replyError(m, errProtocol, "invalid info_hash", addr)
+			return
+		}
+
+		var infoHash nodeID
+		copy(infoHash[:], m.A.InfoHash)
+		res.Token = n.tokens.token(addr.IP)
+		if values := n.peers.get(infoHash); len(values) > 0 {
+			res.Values = values
+		} else {
+			res.Nodes = string(compactNodes(n.table.closest(infoHash, bucketSize)))
+		}
+	case "announce_peer":
+		if len(m.A.InfoHash) != 20 {
+			n.replyError(m, errProtocol, "invalid info_hash", addr)
+			return
+		}
+
+		if !n.tokens.valid(m.A.Token, addr.IP) {
+			n.replyError(m, errProtocol, "bad token", addr)
+			return
+		}
+
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			// The peer is behind a NAT, and listens on the same port it sent the query from
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.replyError(m, errProtocol, "invalid port", addr)
+			return
+		}
+
+		var infoHash nodeID
+		copy(infoHash[:], m.A.InfoHash)
+		n.peers.add(infoHash, p2p.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		n.replyError(m, errMethodUnknown, "method unknown", addr)
+		return
+	}
+
+	if err := n.send(&krpcMsg{T: m.T, Y: "r", R: res}, addr); err != nil {
+		logrus.Debugf("failed to answer '%s' from %s: %s", m.Q, addr.String(), err.Error())
+	}
+}
+
+func (n *Node) replyError(m *krpcMsg, code int, message string, addr *net.UDPAddr) {
+	if err := n.sendError(m.T, code, message, addr); err != nil {
+		logrus.Debugf("failed to answer '%s' from %s: %s", m.Q, addr.String(), err.Error())
+	}
+}
+
+/*
+Pings the node at the given "host:port", adding it to the routing table if it answers
+*/
+func (n *Node) AddNode(ctx context.Context, hostPort string) error {
+	addr, err := net.ResolveUDPAddr("udp4", hostPort)
+	if err != nil {
+		return fmt.Errorf("failed to resolve DHT node %s: %w", hostPort, err)
+	}
+
+	if _, err := n.query(ctx, addr, "ping", krpcArgs{}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Pings every node at once, so the ones answering get added to the routing table
+*/
+func (n *Node) addNodes(ctx context.Context, hostPorts []string) {
+	var wg sync.WaitGroup
+	for _, hostPort := range hostPorts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.AddNode(ctx, hostPort); err != nil {
+				logrus.Debugf("DHT node %s didn't answer: %s", hostPort, err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+/*
+Fills the routing table by looking up our own ID. If none of the nodes we know answers, the bootstrap ones
+are asked first
+*/
+func (n *Node) Bootstrap(ctx context.Context) error {
+	n.mu.Lock()
+	nodes := slices.Clone(n.config.Nodes)
+	n.mu.Unlock()
+
+	n.addNodes(ctx, nodes)
+	if n.table.len() > 0 && n.lookup(ctx, n.id, false).answered > 0 {
+		return nil
+	}
+
+	n.addNodes(ctx, n.config.Bootstrap)
+
+	if n.lookup(ctx, n.id, false).answered == 0 {
+		return errors.New("no DHT node answered")
+	}
+
+	return nil
+}
+
+/*
+Adds nodes to ping on every bootstrap, like the ones listed in a torrent
+*/
+func (n *Node) AddBootstrapNodes(hostPorts ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.config.Nodes = append(n.config.Nodes, hostPorts...)
+}
+
+/*
+Same as GetPeers, joining the DHT first if none of the nodes we know answers
+*/
+func (n *Node) FindPeers(ctx context.Context, infoHash [20]byte) ([]p2p.Peer, error) {
+	if peers, err := n.GetPeers(ctx, infoHash); err == nil {
+		return peers, nil
+	}
+
+	if err := n.Bootstrap(ctx); err != nil {
+		return nil, err
+	}
+
+	return n.GetPeers(ctx, infoHash)
+}
+
+/*
+Looks up the peers of the torrent
+*/
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]p2p.Peer, error) {
+	res := n.lookup(ctx, infoHash, true)
+	if res.answered == 0 {
+		return nil, errors.New("no DHT node answered")
+	}
+
+	return res.peers, nil
+}
+
+/*
+Looks up the peers of the torrent, and tells the closest nodes we are one of them, listening on port
+*/
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]p2p.Peer, error) {
+	res := n.lookup(ctx, infoHash, true)
+	if res.answered == 0 {
+		return nil, errors.New("no DHT node answered")
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range res.closest {
+		token, ok := res.tokens[c.id]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			args := krpcArgs{InfoHash: string(infoHash[:]), Port: int(port), Token: token}
+			if _, err := n.query(ctx, c.addr, "announce_peer", args); err != nil {
+				logrus.Debugf("DHT node %s rejected our announce: %s", c.addr.String(), err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	return res.peers, nil
+}
+
+func (n *Node) refreshLoop() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.peers.sweep()
+
+		ctx, cancel := context.WithTimeout(n.ctx, refreshInterval)
+
+		// Looking up a random ID refreshes the buckets far from us, and our own ID the ones close to us
+		n.lookup(ctx, randomNodeID(), false)
+		n.lookup(ctx, n.id, false)
+		cancel()
+
+		if err := n.saveCache(); err != nil {
+			logrus.Warnf("failed to save DHT node cache: %s", err.Error())
+		}
+	}
+}
+
+/*
+Keeps looking up the peers of the torrent, and announcing we are one of them, sending every batch of peers
+found to the peers channel. If port is 0 we don't announce, as peers couldn't connect to us.
+
+It runs until ctx is done.
+*/
+func (n *Node) AnnounceLoop(ctx context.Context, infoHash [20]byte, port uint16, peers chan<- []p2p.Peer) {
+	wait := time.Duration(0)
+	joined := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if !joined {
+			if err := n.Bootstrap(ctx); err != nil {
+				logrus.Warnf("failed to join the DHT: %s", err.Error())
+				wait = bootstrapRetryInterval
+				continue
+			}
+			joined = true
+		}
+
+		var found []p2p.Peer
+		var err error
+		if port == 0 {
+			found, err = n.GetPeers(ctx, infoHash)
+		} else {
+			found, err = n.Announce(ctx, infoHash, port)
+		}
+
+		if err != nil {
+			logrus.Warnf("DHT lookup failed: %s", err.Error())
+			joined = false
+			wait = bootstrapRetryInterval
+			continue
+		}
+
+		logrus.Debugf("DHT found %d peers", len(found))
+		if len(found) > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case peers <- found:
+			}
+		}
+		wait = announceInterval
+	}
+}
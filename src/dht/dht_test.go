@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+/*
+Address the node is reached on over loopback. Addr() is the wildcard one, which answers wouldn't come from
+*/
+func loopbackAddr(n *Node) string {
+	return fmt.Sprintf("127.0.0.1:%d", n.Addr().Port)
+}
+
+func newTestNode(t *testing.T, nodes ...string) *Node {
+	n, err := New(Config{Port: 0, CachePath: "", Nodes: nodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+
+	return n
+}
+
+/*
+Starts a node, and size others that join the DHT through it, as if it were listed in a torrent
+*/
+func newTestNetwork(t *testing.T, ctx context.Context, size int) (*Node, []*Node) {
+	root := newTestNode(t)
+
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, loopbackAddr(root))
+		if err := nodes[i].Bootstrap(ctx); err != nil {
+			t.Fatalf("node %d failed to bootstrap: %s", i, err.Error())
+		}
+	}
+
+	// The first nodes joined when there were few others, so they look again
+	for _, n := range nodes {
+		if err := n.Bootstrap(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, nodes
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func TestBootstrapThroughNodes(t *testing.T) {
+	ctx := testContext(t)
+	root, nodes := newTestNetwork(t, ctx, 8)
+
+	if root.table.len() != len(nodes) {
+		t.Fatalf("expected the root to know all %d nodes, knows %d", len(nodes), root.table.len())
+	}
+	for i, n := range nodes {
+		// Everyone but itself
+		if n.table.len() != len(nodes) {
+			t.Fatalf("expected node %d to know %d nodes, knows %d", i, len(nodes), n.table.len())
+		}
+	}
+}
+
+func TestFindNodeConverges(t *testing.T) {
+	ctx := testContext(t)
+	root, nodes := newTestNetwork(t, ctx, 12)
+	others := append([]*Node{root}, nodes[1:]...)
+
+	for range 5 {
+		target := randomNodeID()
+		closest := slices.MinFunc(others, func(a, b *Node) int {
+			return compareDistance(target, a.id, b.id)
+		})
+
+		res := nodes[0].lookup(ctx, target, false)
+		if len(res.closest) == 0 {
+			t.Fatal("lookup found no node")
+		}
+		if res.closest[0].id != closest.id {
+			t.Fatalf("expected the closest node to be %x, got %x", closest.id, res.closest[0].id)
+		}
+		if len(res.closest) > 1 && compareDistance(target, res.closest[0].id, res.closest[1].id) > 0 {
+			t.Fatal("expected the nodes found closest first")
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	ctx := testContext(t)
+	_, nodes := newTestNetwork(t, ctx, 8)
+	infoHash := randomNodeID()
+
+	peers, err := nodes[0].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected no peers before announcing, got %v", peers)
+	}
+
+	if _, err := nodes[2].Announce(ctx, infoHash, 4321); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err = nodes[7].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:4321" {
+		t.Fatalf("expected the announced peer, got %v", peers)
+	}
+}
+
+/*
+Replaces the node's token secret with a new one, as it happens every few minutes
+*/
+func rotateTokenSecret(n *Node) {
+	n.tokens.mu.Lock()
+	defer n.tokens.mu.Unlock()
+
+	n.tokens.rotated = time.Now().Add(-tokenSecretLifetime)
+	n.tokens.rotate()
+}
+
+func TestAnnouncePeerTokens(t *testing.T) {
+	ctx := testContext(t)
+	a, b := newTestNode(t), newTestNode(t)
+	infoHash := randomNodeID()
+
+	addr, err := net.ResolveUDPAddr("udp4", loopbackAddr(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := a.query(ctx, addr, "get_peers", krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := res.Token
+
+	announce := func(token string) error {
+		args := krpcArgs{InfoHash: string(infoHash[:]), Port: 4321, Token: token}
+		_, err := a.query(ctx, addr, "announce_peer", args)
+		return err
+	}
+
+	if err := announce(token); err != nil {
+		t.Fatalf("expected the token to be accepted, got %s", err.Error())
+	}
+	if values := b.peers.get(infoHash); len(values) != 1 {
+		t.Fatalf("expected the peer to be stored, got %d", len(values))
+	}
+
+	// Still valid right after the secret changes
+	rotateTokenSecret(b)
+	if err := announce(token); err != nil {
+		t.Fatalf("expected the token to be accepted after a rotation, got %s", err.Error())
+	}
+
+	rotateTokenSecret(b)
+	for _, token := range []string{token, "made up"} {
+		var krpcErr *KRPCError
+		if err := announce(token); !errors.As(err, &krpcErr) || krpcErr.Code != errProtocol {
+			t.Fatalf("expected a protocol error for token %q, got %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+/*
+KRPC is the protocol DHT nodes talk over: single bencoded dictionaries sent over UDP.
+
+A query ('y' = 'q') names the method in 'q' and carries its arguments in 'a'. It's answered with a
+response ('y' = 'r') carrying the values in 'r', or with an error ('y' = 'e'). The answer echoes the
+transaction ID 't' of the query.
+*/
+
+// Time to wait for the answer to a query
+const queryTimeout = 5 * time.Second
+
+// Biggest KRPC message we read
+const maxPacketSize = 8 * 1024
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+/*
+Arguments of every query, and values of every response. Each method uses some of them
+*/
+type krpcArgs struct {
+	ID          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	Nodes       string   `bencode:"nodes,omitempty"`
+	Values      []string `bencode:"values,omitempty"` // Peers in compact form
+}
+
+type krpcMsg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q"`
+	A krpcArgs      `bencode:"a"` // Only in queries
+	R krpcArgs      `bencode:"r"` // Only in responses
+	E []interface{} `bencode:"e"` // Error code and message. Only in errors
+}
+
+/*
+KRPCError is an error answer to one of our queries
+*/
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("error %d: %s", e.Code, e.Message)
+}
+
+func (m *krpcMsg) err() error {
+	e := &KRPCError{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(m.E) > 1 {
+		e.Message, _ = m.E[1].(string)
+	}
+
+	return e
+}
+
+func parseKRPC(b []byte) (m *krpcMsg, err error) {
+	// Anyone can send us anything, and the bencode package panics on some values of the wrong type
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, fmt.Errorf("failed to parse KRPC message: %v", r)
+		}
+	}()
+
+	m = &krpcMsg{}
+	if err := bencode.Unmarshal(bytes.NewReader(b), m); err != nil {
+		return nil, fmt.Errorf("failed to parse KRPC message: %w", err)
+	}
+
+	if m.T == "" {
+		return nil, errors.New("KRPC message without transaction ID")
+	}
+
+	switch m.Y {
+	case "q":
+		if len(m.A.ID) != 20 {
+			return nil, errors.New("query without a valid node ID")
+		}
+	case "r":
+		if len(m.R.ID) != 20 {
+			return nil, errors.New("response without a valid node ID")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type '%s'", m.Y)
+	}
+
+	return m, nil
+}
+
+/*
+Only the keys of the message type get encoded
+*/
+func (m *krpcMsg) dict() map[string]interface{} {
+	d := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		d["q"] = m.Q
+		d["a"] = m.A
+	case "r":
+		d["r"] = m.R
+	case "e":
+		d["e"] = m.E
+	}
+
+	return d
+}
+
+func (n *Node) send(m *krpcMsg, addr *net.UDPAddr) error {
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, m.dict()); err != nil {
+		return fmt.Errorf("failed to marshal KRPC message: %w", err)
+	}
+
+	if _, err := n.conn.WriteToUDP(buf.Bytes(), addr); err != nil {
+		return fmt.Errorf("failed to send KRPC message: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Sends the query and waits for its answer. The node gets added to the routing table if it answers
+*/
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args krpcArgs) (*krpcArgs, error) {
+	args.ID = string(n.id[:])
+
+	n.mu.Lock()
+	n.nextTx++
+	t := string(binary.BigEndian.AppendUint16(nil, n.nextTx))
+	answer := make(chan *krpcMsg, 1)
+	n.pending[t] = pendingQuery{addr: addr, answer: answer}
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, t)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(&krpcMsg{T: t, Y: "q", Q: method, A: args}, addr); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(queryTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, errors.New("node closed")
+	case <-timeout.C:
+		return nil, fmt.Errorf("'%s' to %s timed out", method, addr.String())
+	case m := <-answer:
+		if m.Y == "e" {
+			return nil, m.err()
+		}
+
+		var id nodeID
+		copy(id[:], m.R.ID)
+		n.nodeSeen(id, addr)
+
+		return &m.R, nil
+	}
+}
+
+/*
+Passes the answer to the query waiting for it. Answers from an address other than the one queried are ignored
+*/
+func (n *Node) handleAnswer(m *krpcMsg, addr *net.UDPAddr) {
+	n.mu.Lock()
+	q, ok := n.pending[m.T]
+	n.mu.Unlock()
+
+	if !ok || !q.addr.IP.Equal(addr.IP) || q.addr.Port != addr.Port {
+		return
+	}
+
+	select {
+	case q.answer <- m:
+	default:
+	}
+}
+
+func (n *Node) sendError(t string, code int, message string, addr *net.UDPAddr) error {
+	return n.send(&krpcMsg{T: t, Y: "e", E: []interface{}{code, message}}, addr)
+}
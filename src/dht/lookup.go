@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/sirupsen/logrus"
+)
+
+// Queries sent at the same time during a lookup
+const alpha = 3
+
+type lookupResult struct {
+	closest  []*contact        // Closest nodes that answered, closest first
+	tokens   map[nodeID]string // Tokens the nodes gave us on get_peers, needed to announce to them
+	peers    []p2p.Peer        // Peers the nodes gave us on get_peers
+	answered int
+}
+
+type lookupAnswer struct {
+	c   *contact
+	res *krpcArgs
+	err error
+}
+
+/*
+Asks the nodes closest to target for the ones they know even closer, until the closest nodes found have
+all been asked. With getPeers, get_peers is sent instead of find_node, which also returns the peers of the
+info hash target, if the node knows any.
+*/
+func (n *Node) lookup(ctx context.Context, target nodeID, getPeers bool) lookupResult {
+	method, args := "find_node", krpcArgs{Target: string(target[:])}
+	if getPeers {
+		method, args = "get_peers", krpcArgs{InfoHash: string(target[:])}
+	}
+
+	result := lookupResult{tokens: make(map[nodeID]string)}
+	candidates := n.table.closest(target, bucketSize) // Closest first. Nodes that don't answer get removed
+	known := make(map[nodeID]bool)
+	for _, c := range candidates {
+		known[c.id] = true
+	}
+	queried := make(map[nodeID]bool)
+	peersFound := make(map[string]bool)
+
+	answers := make(chan lookupAnswer)
+	inFlight := 0
+
+	// The first of the closest candidates not queried yet. Once there's none, the lookup is over
+	next := func() *contact {
+		for _, c := range candidates[:min(bucketSize, len(candidates))] {
+			if !queried[c.id] {
+				return c
+			}
+		}
+
+		return nil
+	}
+
+	for {
+		for inFlight < alpha && ctx.Err() == nil {
+			c := next()
+			if c == nil {
+				break
+			}
+
+			queried[c.id] = true
+			inFlight++
+			go func() {
+				res, err := n.query(ctx, c.addr, method, args)
+				answers <- lookupAnswer{c: c, res: res, err: err}
+			}()
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		a := <-answers
+		inFlight--
+
+		if a.err != nil {
+			candidates = slices.DeleteFunc(candidates, func(c *contact) bool { return c == a.c })
+			if ctx.Err() == nil {
+				n.table.failed(a.c.id)
+			}
+			continue
+		}
+
+		result.answered++
+		result.closest = append(result.closest, a.c)
+		if getPeers && a.res.Token != "" {
+			result.tokens[a.c.id] = a.res.Token
+		}
+
+		for _, v := range a.res.Values {
+			if len(v) != 6 || peersFound[v] {
+				continue
+			}
+
+			peersFound[v] = true
+			result.peers = append(result.peers, p2p.Peer{
+				IP:   net.IP([]byte(v[:4])),
+				Port: binary.BigEndian.Uint16([]byte(v[4:6])),
+			})
+		}
+
+		nodes, err := parseCompactNodes([]byte(a.res.Nodes))
+		if err != nil {
+			logrus.Debugf("DHT node %s sent invalid nodes: %s", a.c.addr.String(), err.Error())
+			continue
+		}
+		for _, c := range nodes {
+			if known[c.id] || c.id == n.id || c.addr.Port == 0 {
+				continue
+			}
+
+			known[c.id] = true
+			candidates = append(candidates, c)
+		}
+		slices.SortFunc(candidates, func(a, b *contact) int {
+			return compareDistance(target, a.id, b.id)
+		})
+	}
+
+	slices.SortFunc(result.closest, func(a, b *contact) int {
+		return compareDistance(target, a.id, b.id)
+	})
+	result.closest = result.closest[:min(bucketSize, len(result.closest))]
+
+	return result
+}
@@ -0,0 +1,240 @@
+package dht
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Nodes kept in each bucket, and nodes returned by find_node and get_peers
+const bucketSize = 8
+
+// Nodes not heard from in this long may have left, and get replaced if they don't answer a ping
+const questionableAfter = 15 * time.Minute
+
+// Nodes failing to answer this many queries in a row are dropped
+const maxFailures = 2
+
+// Size of a node in compact form: its ID, IPv4 address and port
+const compactNodeLen = 26
+
+type nodeID [20]byte
+
+func randomNodeID() nodeID {
+	var id nodeID
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+/*
+Number of leading bits both IDs share
+*/
+func commonPrefixLen(a, b nodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(a) * 8
+}
+
+/*
+Compares the XOR distances from a and from b to target
+*/
+func compareDistance(target, a, b nodeID) int {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return cmp.Compare(da, db)
+		}
+	}
+
+	return 0
+}
+
+type contact struct {
+	id       nodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+/*
+Encodes the nodes in compact form. Nodes without an IPv4 address are skipped
+*/
+func compactNodes(nodes []*contact) []byte {
+	b := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, c := range nodes {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		b = append(b, c.id[:]...)
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, uint16(c.addr.Port))
+	}
+
+	return b
+}
+
+func parseCompactNodes(b []byte) ([]*contact, error) {
+	if len(b)%compactNodeLen != 0 {
+		return nil, errors.New("malformed compact nodes")
+	}
+
+	nodes := make([]*contact, 0, len(b)/compactNodeLen)
+	for i := 0; i < len(b); i += compactNodeLen {
+		c := &contact{
+			addr: &net.UDPAddr{
+				IP:   net.IP(slices.Clone(b[i+20 : i+24])),
+				Port: int(binary.BigEndian.Uint16(b[i+24 : i+26])),
+			},
+		}
+		copy(c.id[:], b[i:i+20])
+		nodes = append(nodes, c)
+	}
+
+	return nodes, nil
+}
+
+/*
+routingTable keeps the nodes we know of, in one bucket per length of the prefix they share with our ID.
+So we know many nodes close to us, and a few from every other part of the ID space, which is enough to get
+closer to any ID in a few steps.
+*/
+type routingTable struct {
+	self nodeID
+
+	mu      sync.Mutex
+	buckets [161][]*contact // Least recently seen first. Our own ID would go in the last one, which stays empty
+}
+
+func newRoutingTable(self nodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (t *routingTable) bucket(id nodeID) int {
+	return commonPrefixLen(t.self, id)
+}
+
+/*
+Records that the node answered, or sent us a query. If its bucket is full, the node that has been
+quiet for the longest is returned, so it gets pinged. It should be replaced if it doesn't answer
+*/
+func (t *routingTable) seen(id nodeID, addr *net.UDPAddr) (stale *contact) {
+	if id == t.self || addr.Port == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(id)
+	bucket := t.buckets[i]
+	for j, c := range bucket {
+		if c.id == id {
+			c.addr = addr
+			c.lastSeen = time.Now()
+			c.failures = 0
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return nil
+		}
+	}
+
+	c := &contact{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < bucketSize {
+		t.buckets[i] = append(bucket, c)
+		return nil
+	}
+
+	for j, old := range bucket {
+		if old.failures >= maxFailures {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return nil
+		}
+	}
+
+	if time.Since(bucket[0].lastSeen) > questionableAfter {
+		copied := *bucket[0]
+		return &copied
+	}
+
+	return nil
+}
+
+/*
+Records that the node didn't answer a query
+*/
+func (t *routingTable) failed(id nodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, c := range t.buckets[t.bucket(id)] {
+		if c.id == id {
+			c.failures++
+		}
+	}
+}
+
+/*
+Puts c in the place of the stale node, which didn't answer its ping
+*/
+func (t *routingTable) replace(stale nodeID, c *contact) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(stale)
+	bucket := t.buckets[i]
+	for j, old := range bucket {
+		if old.id == stale {
+			c.lastSeen = time.Now()
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return
+		}
+	}
+}
+
+/*
+The n good nodes closest to target, closest first
+*/
+func (t *routingTable) closest(target nodeID, n int) []*contact {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]*contact, 0)
+	for _, bucket := range t.buckets {
+		for _, c := range bucket {
+			if c.failures < maxFailures {
+				copied := *c
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+
+	slices.SortFunc(nodes, func(a, b *contact) int {
+		return compareDistance(target, a.id, b.id)
+	})
+
+	return nodes[:min(n, len(nodes))]
+}
+
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+
+	return n
+}
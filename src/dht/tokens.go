@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+)
+
+// The secret tokens are made from changes this often. Tokens from the previous secret are still accepted
+const tokenSecretLifetime = 5 * time.Minute
+
+// Peers not announced again in this long are forgotten
+const peerLifetime = 30 * time.Minute
+
+// Most peers returned by get_peers, so the response fits in a single packet
+const maxPeerValues = 50
+
+// Most peers kept per info hash, and info hashes kept peers for, so announces can't use up our memory
+const (
+	maxStoredPeers      = 100
+	maxStoredInfoHashes = 1000
+)
+
+/*
+tokenManager hands out the tokens a node must send back on announce_peer, proving it asked us
+with get_peers from the same IP shortly before. It's what keeps nodes from announcing other IPs.
+*/
+type tokenManager struct {
+	mu       sync.Mutex
+	secret   [16]byte
+	previous [16]byte
+	rotated  time.Time
+}
+
+func newTokenManager() *tokenManager {
+	m := &tokenManager{rotated: time.Now()}
+	_, _ = rand.Read(m.secret[:])
+	m.previous = m.secret
+
+	return m
+}
+
+func (m *tokenManager) rotate() {
+	if time.Since(m.rotated) < tokenSecretLifetime {
+		return
+	}
+
+	m.previous = m.secret
+	_, _ = rand.Read(m.secret[:])
+	m.rotated = time.Now()
+}
+
+func tokenFor(secret [16]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+
+	return string(h.Sum(nil)[:8])
+}
+
+func (m *tokenManager) token(ip net.IP) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+
+	return tokenFor(m.secret, ip)
+}
+
+func (m *tokenManager) valid(token string, ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+
+	for _, secret := range [][16]byte{m.secret, m.previous} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tokenFor(secret, ip))) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+peerStore keeps the peers announced to us for each info hash.
+
+Once an info hash has too many peers, a new one replaces the one announced the longest ago. Announces of new
+info hashes are ignored while there are too many of them.
+*/
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[nodeID]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer     p2p.Peer
+	announce time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		peers: make(map[nodeID]map[string]storedPeer),
+	}
+}
+
+func (s *peerStore) add(infoHash nodeID, peer p2p.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := s.peers[infoHash]
+	if peers == nil {
+		if len(s.peers) >= maxStoredInfoHashes {
+			return
+		}
+
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+
+	addr := peer.String()
+	if _, ok := peers[addr]; !ok && len(peers) >= maxStoredPeers {
+		var oldest string
+		for a, sp := range peers {
+			if oldest == "" || sp.announce.Before(peers[oldest].announce) {
+				oldest = a
+			}
+		}
+		delete(peers, oldest)
+	}
+
+	peers[addr] = storedPeer{peer: peer, announce: time.Now()}
+}
+
+/*
+Forgets the expired peers, and the info hashes left without any
+*/
+func (s *peerStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, peers := range s.peers {
+		for addr, sp := range peers {
+			if time.Since(sp.announce) > peerLifetime {
+				delete(peers, addr)
+			}
+		}
+
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+/*
+Some of the peers announced for the info hash, in compact form. Expired ones get dropped
+*/
+func (s *peerStore) get(infoHash nodeID) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([]string, 0)
+	for addr, sp := range s.peers[infoHash] {
+		if time.Since(sp.announce) > peerLifetime {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+
+		ip := sp.peer.IP.To4()
+		if ip == nil || len(values) >= maxPeerValues {
+			continue
+		}
+		values = append(values, string(binary.BigEndian.AppendUint16(slices.Clone(ip), sp.peer.Port)))
+	}
+
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+
+	return values
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+)
+
+func TestPeerStoreLimits(t *testing.T) {
+	s := newPeerStore()
+	infoHash := randomNodeID()
+
+	for i := range maxStoredPeers + 10 {
+		s.add(infoHash, p2p.Peer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881})
+	}
+	if len(s.peers[infoHash]) != maxStoredPeers {
+		t.Fatalf("expected %d peers, got %d", maxStoredPeers, len(s.peers[infoHash]))
+	}
+	// The first ones announced were replaced
+	if _, ok := s.peers[infoHash]["10.0.0.0:6881"]; ok {
+		t.Fatal("expected the oldest peer to be replaced")
+	}
+
+	for len(s.peers) < maxStoredInfoHashes {
+		s.add(randomNodeID(), p2p.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	}
+	s.add(randomNodeID(), p2p.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	if len(s.peers) != maxStoredInfoHashes {
+		t.Fatalf("expected %d info hashes, got %d", maxStoredInfoHashes, len(s.peers))
+	}
+}
+
+func expirePeer(s *peerStore, infoHash nodeID, addr string) {
+	sp := s.peers[infoHash][addr]
+	sp.announce = time.Now().Add(-peerLifetime - time.Minute)
+	s.peers[infoHash][addr] = sp
+}
+
+func TestPeerStoreSweep(t *testing.T) {
+	s := newPeerStore()
+	expired, fresh := randomNodeID(), randomNodeID()
+
+	s.add(expired, p2p.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	s.add(fresh, p2p.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	s.add(fresh, p2p.Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6881})
+	expirePeer(s, expired, "10.0.0.1:6881")
+	expirePeer(s, fresh, "10.0.0.2:6881")
+
+	s.sweep()
+
+	if _, ok := s.peers[expired]; ok {
+		t.Fatal("expected the info hash without peers to be forgotten")
+	}
+	if len(s.peers[fresh]) != 1 {
+		t.Fatalf("expected 1 peer left, got %d", len(s.peers[fresh]))
+	}
+}
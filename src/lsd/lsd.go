@@ -0,0 +1,288 @@
+/*
+Package lsd implements Local Service Discovery (BEP 14), which finds peers of the same torrents on the
+local network without trackers.
+
+Every client announces the info hashes it's downloading, and the port it accepts peers on, to a multicast
+group every few minutes. The clients listening on that group connect to the ones announcing the torrents
+they have too.
+
+Only the IPv4 group is used.
+
+https://www.bittorrent.org/beps/bep_0014.html
+*/
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/sirupsen/logrus"
+)
+
+// Multicast group announces are sent to
+const DefaultAddr = "239.192.152.143:6771"
+
+// How often each torrent is announced
+const announceInterval = 5 * time.Minute
+
+// Biggest announce we read
+const maxPacketSize = 1400
+
+// Batches of peers waiting to be passed on, per torrent. Further ones are dropped, as peers announce again anyway
+const foundQueueSize = 16
+
+type Config struct {
+	Addr string // "host:port" announces are sent to and read from. Empty for the multicast group, see New for others
+	Port uint16 // Port peers can connect to us on. 0 to only listen to the announces of others
+}
+
+/*
+Service sends our announces and listens to the ones of other clients, until closed
+*/
+type Service struct {
+	conn   *net.UDPConn // Receives the announces
+	send   *net.UDPConn // The same as conn when it's not multicast
+	addr   *net.UDPAddr
+	port   uint16
+	cookie string // Sent with our announces, to tell them apart when they come back to us
+
+	mu       sync.Mutex
+	torrents map[[20]byte]chan []p2p.Peer // Peers found for each torrent being announced
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+/*
+Joins the multicast group. If the address in the config isn't a multicast one, announces are sent to it
+instead, and read from whatever it sends back, as a relay passing them on to the clients on its host
+*/
+func New(config Config) (*Service, error) {
+	hostPort := config.Addr
+	if hostPort == "" {
+		hostPort = DefaultAddr
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve LSD address %s: %w", hostPort, err)
+	}
+
+	var conn, send *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr.String(), err)
+		}
+
+		send, err = net.ListenUDP("udp4", nil)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to open LSD socket: %w", err)
+		}
+	} else {
+		// A unicast address can't be shared by several clients, so it has to pass the announces on to them
+		conn, err = net.ListenUDP("udp4", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open LSD socket: %w", err)
+		}
+		send = conn
+	}
+
+	cookie := make([]byte, 8)
+	_, _ = rand.Read(cookie)
+
+	s := &Service{
+		conn:     conn,
+		send:     send,
+		addr:     addr,
+		port:     config.Port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]chan []p2p.Peer),
+		closed:   make(chan struct{}),
+	}
+
+	go s.readLoop()
+
+	return s, nil
+}
+
+func (s *Service) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		if s.send != s.conn {
+			err = errors.Join(err, s.send.Close())
+		}
+	})
+
+	return err
+}
+
+/*
+Announces the torrent every few minutes, sending the peers found announcing it too to the peers channel.
+
+It runs until ctx is done.
+*/
+func (s *Service) AnnounceLoop(ctx context.Context, infoHash [20]byte, peers chan<- []p2p.Peer) {
+	found := make(chan []p2p.Peer, foundQueueSize)
+	s.mu.Lock()
+	s.torrents[infoHash] = found
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.torrents, infoHash)
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+
+	s.announce(infoHash)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.announce(infoHash)
+		case batch := <-found:
+			select {
+			case <-ctx.Done():
+				return
+			case peers <- batch:
+			}
+		}
+	}
+}
+
+func (s *Service) announce(infoHash [20]byte) {
+	if s.port == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf(
+		"BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\nInfohash: %s\r\ncookie: %s\r\n\r\n\r\n",
+		s.addr.String(), s.port, hex.EncodeToString(infoHash[:]), s.cookie,
+	)
+	if _, err := s.send.WriteToUDP([]byte(msg), s.addr); err != nil {
+		logrus.Debugf("failed to send LSD announce: %s", err.Error())
+	}
+}
+
+func (s *Service) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			logrus.Debugf("failed to read LSD announce: %s", err.Error())
+			continue
+		}
+
+		a, err := parseAnnounce(buf[:size])
+		if err != nil {
+			logrus.Debugf("invalid LSD announce from %s: %s", from.String(), err.Error())
+			continue
+		}
+
+		if a.cookie == s.cookie {
+			continue
+		}
+
+		s.found(a, p2p.Peer{IP: from.IP, Port: a.port})
+	}
+}
+
+/*
+Passes the peer on to the torrents it announced that we are announcing too
+*/
+func (s *Service) found(a announce, peer p2p.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, infoHash := range a.infoHashes {
+		found, ok := s.torrents[infoHash]
+		if !ok {
+			continue
+		}
+
+		logrus.Debugf("found peer %s on the local network", peer.String())
+		select {
+		case found <- []p2p.Peer{peer}:
+		default:
+		}
+	}
+}
+
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+/*
+Announces look like HTTP requests, with one 'Infohash' header per torrent announced
+*/
+func parseAnnounce(b []byte) (announce, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return announce{}, fmt.Errorf("failed to read request line: %w", err)
+	}
+	if !strings.HasPrefix(line, "BT-SEARCH * HTTP/1.") {
+		return announce{}, fmt.Errorf("unexpected request line '%s'", line)
+	}
+
+	// Some clients leave out the empty lines at the end
+	header, err := r.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return announce{}, fmt.Errorf("failed to read headers: %w", err)
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return announce{}, fmt.Errorf("invalid port '%s'", header.Get("Port"))
+	}
+
+	a := announce{port: uint16(port), cookie: header.Get("Cookie")}
+	for _, h := range header.Values("Infohash") {
+		h = strings.TrimSpace(h)
+		var infoHash [20]byte
+		if len(h) != hex.EncodedLen(len(infoHash)) {
+			return announce{}, fmt.Errorf("invalid info hash '%s'", h)
+		}
+		if _, err := hex.Decode(infoHash[:], []byte(h)); err != nil {
+			return announce{}, fmt.Errorf("invalid info hash '%s': %w", h, err)
+		}
+
+		a.infoHashes = append(a.infoHashes, infoHash)
+	}
+
+	if len(a.infoHashes) == 0 {
+		return announce{}, errors.New("no info hash announced")
+	}
+
+	return a, nil
+}
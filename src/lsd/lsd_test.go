@@ -0,0 +1,173 @@
+package lsd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+)
+
+/*
+relay passes every announce on to every client it heard from, the sender included, as the multicast group does
+*/
+type relay struct {
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	clients []*net.UDPAddr
+	echoes  int // Announces sent back to their sender
+}
+
+func newRelay(t *testing.T) *relay {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &relay{conn: conn}
+	go r.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return r
+}
+
+func (r *relay) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		known := false
+		for _, c := range r.clients {
+			known = known || c.String() == from.String()
+		}
+		if !known {
+			r.clients = append(r.clients, from)
+		}
+		r.echoes++
+		clients := r.clients
+		r.mu.Unlock()
+
+		for _, c := range clients {
+			r.conn.WriteToUDP(buf[:n], c)
+		}
+	}
+}
+
+func (r *relay) counts() (clients, echoes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.clients), r.echoes
+}
+
+func (r *relay) waitForClients(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if clients, _ := r.counts(); clients >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients to announce", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestService(t *testing.T, addr string, port uint16) *Service {
+	s, err := New(Config{Addr: addr, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+/*
+Waits for the peer to be found, failing if any other one is
+*/
+func expectPeer(t *testing.T, peers <-chan []p2p.Peer, want string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("expected to find peer %s", want)
+		case batch := <-peers:
+			for _, peer := range batch {
+				if peer.String() != want {
+					t.Fatalf("expected to find peer %s, found %s", want, peer.String())
+				}
+			}
+			if len(batch) > 0 {
+				return
+			}
+		}
+	}
+}
+
+func TestAnnouncesThroughRelay(t *testing.T) {
+	r := newRelay(t)
+	addr := r.conn.LocalAddr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var infoHash [20]byte
+	copy(infoHash[:], "0123456789abcdefghij")
+
+	a, b := newTestService(t, addr, 1111), newTestService(t, addr, 2222)
+	aPeers, bPeers := make(chan []p2p.Peer, 8), make(chan []p2p.Peer, 8)
+
+	go a.AnnounceLoop(ctx, infoHash, aPeers)
+	r.waitForClients(t, 1)
+	go b.AnnounceLoop(ctx, infoHash, bPeers)
+	r.waitForClients(t, 2)
+
+	// b wasn't known to the relay when a first announced
+	a.announce(infoHash)
+
+	expectPeer(t, aPeers, "127.0.0.1:2222")
+	expectPeer(t, bPeers, "127.0.0.1:1111")
+
+	// Both got their own announces back, which are ignored thanks to the cookie
+	if _, echoes := r.counts(); echoes < 3 {
+		t.Fatalf("expected the 3 announces to be echoed, got %d", echoes)
+	}
+	select {
+	case batch := <-aPeers:
+		t.Fatalf("expected a to ignore its own announces, found %v", batch)
+	case batch := <-bPeers:
+		t.Fatalf("expected b to ignore its own announces, found %v", batch)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseAnnounce(t *testing.T) {
+	msg := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+		"Infohash: 3031323334353637383961626364656667686970\r\ncookie: abc\r\n\r\n\r\n"
+
+	a, err := parseAnnounce([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.port != 6881 || a.cookie != "abc" || len(a.infoHashes) != 1 || string(a.infoHashes[0][:]) != "0123456789abcdefghip" {
+		t.Fatalf("unexpected announce %+v", a)
+	}
+
+	for _, msg := range []string{
+		"GET / HTTP/1.1\r\nPort: 6881\r\nInfohash: 3031323334353637383961626364656667686970\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: 3031323334353637383961626364656667686970\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 30313233\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	} {
+		if _, err := parseAnnounce([]byte(msg)); err == nil {
+			t.Fatalf("expected %q to be rejected", msg)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/sirupsen/logrus"
+)
+
+// Used when the tracker doesn't say how often to announce
+const defaultAnnounceInterval = 30 * time.Minute
+
+// Floor for early announces when the tracker doesn't set a 'min interval'
+const defaultMinAnnounceInterval = time.Minute
+
+// Wait before retrying after every tracker failed. Doubles on each consecutive failure
+const announceRetryInterval = 15 * time.Second
+
+// Below this many connected peers, the announcer asks for more as soon as the trackers allow it
+const LowPeersThreshold = 10
+
+/*
+Announcer keeps announcing to the torrent's trackers in the background, honoring the interval they set,
+and sends every batch of peers it gets to the peers channel.
+*/
+type Announcer struct {
+	torr           *torrent.Torrent
+	trackers       *Trackers
+	stats          *TransferStats
+	peers          chan<- []Peer
+	connectedPeers atomic.Int64
+	needPeers      chan struct{}
+	completed      chan struct{}
+}
+
+/*
+stats must be kept up to date by the download, as they are reported on every announce
+*/
+func NewAnnouncer(torr *torrent.Torrent, peers chan<- []Peer, stats *TransferStats) *Announcer {
+	return &Announcer{
+		torr:      torr,
+		trackers:  NewTrackers(torr),
+		stats:     stats,
+		peers:     peers,
+		needPeers: make(chan struct{}, 1),
+		completed: make(chan struct{}, 1),
+	}
+}
+
+/*
+Must be called once the last piece is verified, to send the 'completed' event. It never blocks
+*/
+func (a *Announcer) Completed() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Must be called whenever the amount of connected peers changes.
+If they are too few, an announce is made as soon as the trackers' 'min interval' allows it. It never blocks
+*/
+func (a *Announcer) UpdateConnectedPeers(n int) {
+	a.connectedPeers.Store(int64(n))
+	if n >= LowPeersThreshold {
+		return
+	}
+
+	select {
+	case a.needPeers <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Announcer) lowOnPeers() bool {
+	return a.connectedPeers.Load() < LowPeersThreshold
+}
+
+/*
+Tells the trackers we are leaving. Only makes sense if they know about us.
+
+The download may finish right before leaving, so a pending 'completed' is sent first.
+*/
+func (a *Announcer) finish(pending AnnounceEvent) {
+	select {
+	case <-a.completed:
+		pending = EventCompleted
+	default:
+	}
+
+	if pending == EventCompleted {
+		if _, err := a.trackers.announce(a.torr, newAnnounceParams(EventCompleted, a.stats)); err != nil {
+			logrus.Warnf("failed to announce 'completed': %s", err.Error())
+		}
+	}
+
+	if _, err := a.trackers.announce(a.torr, newAnnounceParams(EventStopped, a.stats)); err != nil {
+		logrus.Warnf("failed to announce 'stopped': %s", err.Error())
+	}
+}
+
+/*
+Announces right away and then keeps doing it until workCtx is done, when the 'stopped' event is sent
+*/
+func (a *Announcer) Run(workCtx context.Context) {
+	interval := defaultAnnounceInterval
+	minInterval := defaultMinAnnounceInterval
+	retryInterval := announceRetryInterval
+	var lastAnnounce, nextAnnounce time.Time
+
+	// Events are kept until a tracker receives them
+	event := EventStarted
+	started := false
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	schedule := func(wait time.Duration) {
+		nextAnnounce = time.Now().Add(wait)
+		timer.Reset(wait)
+	}
+
+	for {
+		select {
+		case <-workCtx.Done():
+			if started {
+				a.finish(event)
+			}
+			return
+		case <-a.completed:
+			event = EventCompleted
+			timer.Stop()
+		case <-a.needPeers:
+			if !a.lowOnPeers() {
+				continue
+			}
+
+			earliest := lastAnnounce.Add(minInterval)
+			if !earliest.Before(nextAnnounce) {
+				continue
+			}
+
+			if wait := time.Until(earliest); wait > 0 {
+				schedule(wait)
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		lastAnnounce = time.Now()
+		res, err := a.trackers.announce(a.torr, newAnnounceParams(event, a.stats))
+		if err != nil {
+			logrus.Warnf("failed to announce: %s. retrying in %s", err.Error(), retryInterval)
+			schedule(retryInterval)
+			retryInterval = min(retryInterval*2, interval)
+			continue
+		}
+		retryInterval = announceRetryInterval
+		started = true
+		event = EventNone
+
+		if res.interval > 0 {
+			interval = res.interval
+		}
+		minInterval = defaultMinAnnounceInterval
+		if res.minInterval > 0 {
+			minInterval = res.minInterval
+		}
+
+		logrus.Debugf("tracker returned %d peers. next announce in %s", len(res.peers), interval)
+
+		select {
+		case <-workCtx.Done():
+			a.finish(event)
+			return
+		case a.peers <- res.peers:
+		}
+
+		if a.lowOnPeers() {
+			schedule(minInterval)
+		} else {
+			schedule(interval)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often the unchoked peers are chosen again
+const rechokeInterval = 10 * time.Second
+
+// The optimistic unchoke changes every this many rechokes (30 seconds)
+const optimisticRounds = 3
+
+// Peers we upload to at the same time, the optimistic unchoke included
+const UploadSlots = 4
+
+// Peers connected for less than this are more likely to get the optimistic unchoke
+const newPeerPeriod = time.Minute
+
+/*
+Choker decides which peers we upload to, following the tit-for-tat algorithm described in BEP 3.
+
+Every 10 seconds, the interested peers that gave us the most data during the last round get unchoked,
+or the ones we sent the most data to if we are seeding, and the rest get choked. One more slot goes to
+a random interested peer, which changes every 30 seconds, so new peers get a chance to show what they give.
+
+https://www.bittorrent.org/beps/bep_0003.html
+*/
+type Choker struct {
+	seeding func() bool
+
+	mu         sync.Mutex
+	peers      map[*PeerConn]*chokerPeer
+	optimistic *PeerConn
+	round      int
+	nudge      chan struct{}
+}
+
+type chokerPeer struct {
+	connectedAt time.Time
+	downloaded  uint64 // Counts at the start of the round
+	uploaded    uint64
+	rate        uint64 // Bytes transferred during the last round
+}
+
+/*
+seeding reports whether we have the whole torrent, so peers get ranked by what we upload to them
+*/
+func NewChoker(seeding func() bool) *Choker {
+	return &Choker{
+		seeding: seeding,
+		peers:   make(map[*PeerConn]*chokerPeer),
+		nudge:   make(chan struct{}, 1),
+	}
+}
+
+func (c *Choker) AddPeer(p *PeerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peers[p] = &chokerPeer{
+		connectedAt: time.Now(),
+		downloaded:  p.Downloaded(),
+		uploaded:    p.Uploaded(),
+	}
+}
+
+func (c *Choker) RemovePeer(p *PeerConn) {
+	c.mu.Lock()
+	unchoked := !p.AmChoking()
+	delete(c.peers, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+	c.mu.Unlock()
+
+	if unchoked {
+		c.InterestChanged()
+	}
+}
+
+/*
+Must be called whenever a peer becomes interested or not interested, so a free slot gets taken
+without waiting for the next round. It never blocks
+*/
+func (c *Choker) InterestChanged() {
+	select {
+	case c.nudge <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Rechokes every 10 seconds until ctx is done
+*/
+func (c *Choker) Run(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.rechoke(true)
+		case <-c.nudge:
+			c.rechoke(false)
+		}
+	}
+}
+
+/*
+Chooses the peers to unchoke and sends the messages needed. The rates are only measured, and the
+optimistic unchoke only rotated, at the end of a round
+*/
+func (c *Choker) rechoke(endOfRound bool) {
+	// Asked before locking, as the download may call the choker while holding its own lock
+	seeding := c.seeding()
+
+	c.mu.Lock()
+
+	if endOfRound {
+		c.measureRates(seeding)
+		c.round++
+	}
+
+	if c.optimistic != nil && !c.optimistic.PeerInterested() {
+		c.optimistic = nil
+	}
+	if c.optimistic == nil || (endOfRound && c.round%optimisticRounds == 0) {
+		c.optimistic = c.pickOptimistic()
+	}
+
+	ranked := make([]*PeerConn, 0, len(c.peers))
+	for p := range c.peers {
+		if p.PeerInterested() && p != c.optimistic {
+			ranked = append(ranked, p)
+		}
+	}
+	slices.SortFunc(ranked, func(a, b *PeerConn) int {
+		// Fastest first
+		return cmp.Compare(c.peers[b].rate, c.peers[a].rate)
+	})
+
+	unchoke := make(map[*PeerConn]struct{}, UploadSlots)
+	slots := UploadSlots
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = struct{}{}
+		slots--
+	}
+	for _, p := range ranked[:min(slots, len(ranked))] {
+		unchoke[p] = struct{}{}
+	}
+
+	peers := make([]*PeerConn, 0, len(c.peers))
+	for p := range c.peers {
+		peers = append(peers, p)
+	}
+	c.mu.Unlock()
+
+	// Messages are sent without holding the lock, as a slow peer could block everyone else
+	for _, p := range peers {
+		_, wanted := unchoke[p]
+
+		var err error
+		if wanted && p.AmChoking() {
+			err = p.SendUnchoke()
+		} else if !wanted && !p.AmChoking() {
+			err = p.SendChoke()
+		}
+
+		if err != nil {
+			peer := p.GetPeer()
+			logrus.Debugf("couldn't update choke state of peer %s: %s", peer.String(), err.Error())
+		}
+	}
+}
+
+func (c *Choker) measureRates(seeding bool) {
+	for p, cp := range c.peers {
+		downloaded, uploaded := p.Downloaded(), p.Uploaded()
+		if seeding {
+			cp.rate = uploaded - cp.uploaded
+		} else {
+			cp.rate = downloaded - cp.downloaded
+		}
+		cp.downloaded, cp.uploaded = downloaded, uploaded
+	}
+}
+
+/*
+Picks a random interested peer among the choked ones. New peers are three times as likely to be picked,
+as they have nothing to offer yet
+*/
+func (c *Choker) pickOptimistic() *PeerConn {
+	candidates := make([]*PeerConn, 0)
+	for p, cp := range c.peers {
+		if !p.PeerInterested() || (!p.AmChoking() && p != c.optimistic) {
+			continue
+		}
+
+		candidates = append(candidates, p)
+		if time.Since(cp.connectedAt) < newPeerPeriod {
+			candidates = append(candidates, p, p)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.IntN(len(candidates))]
+}
@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/TatuMon/bittorrent-client/logger"
+	"github.com/jackpal/bencode-go"
+)
+
+/*
+Extension protocol (BEP 10).
+
+Every extended message is sent with ID MsgExtended, and the first byte of the payload identifies the
+extension. ID 0 is reserved for the extended handshake, where each side tells the other which ID it
+wants to receive each extension with, so the IDs used to send and to receive a message may differ.
+
+https://www.bittorrent.org/beps/bep_0010.html
+*/
+
+const extendedHandshakeID = 0
+
+const clientVersion = "TM 0.0.1"
+
+// Requests peers may keep outstanding with us, sent as 'reqq'. Each one is served as soon as it's read
+const maxIncomingRequests = 250
+
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"` // Extension names mapped to the ID the sender wants to receive them with. 0 means disabled
+	Version      string         `bencode:"v,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"` // Number of outstanding requests the sender supports
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+/*
+Handles the payload (without the extension ID) of a message received for a registered extension
+*/
+type ExtensionHandler func(p *PeerConn, payload []byte) error
+
+type extensionRegistry struct {
+	mu       sync.RWMutex
+	ids      map[string]byte
+	handlers map[byte]ExtensionHandler
+}
+
+/*
+Extensions supported by the client. Each one is advertised in every extended handshake.
+*/
+var extensions = &extensionRegistry{
+	ids:      make(map[string]byte),
+	handlers: make(map[byte]ExtensionHandler),
+}
+
+/*
+Registers the handler for the extension, returning the ID peers must use to send us its messages.
+Registering the same name twice replaces the handler, keeping the ID.
+*/
+func RegisterExtension(name string, handler ExtensionHandler) byte {
+	extensions.mu.Lock()
+	defer extensions.mu.Unlock()
+
+	id, ok := extensions.ids[name]
+	if !ok {
+		id = byte(len(extensions.ids) + 1)
+		extensions.ids[name] = id
+	}
+	extensions.handlers[id] = handler
+
+	return id
+}
+
+func (r *extensionRegistry) localIDs() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(map[string]int, len(r.ids))
+	for name, id := range r.ids {
+		m[name] = int(id)
+	}
+
+	return m
+}
+
+func (r *extensionRegistry) localID(name string) byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.ids[name]
+}
+
+func (r *extensionRegistry) handler(id byte) ExtensionHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.handlers[id]
+}
+
+func (p *PeerConn) SupportsExtensions() bool {
+	return p.supportsExtensions
+}
+
+/*
+Reports whether the peer advertised the extension in its extended handshake
+*/
+func (p *PeerConn) SupportsExtension(name string) bool {
+	h := p.extHandshake.Load()
+	return h != nil && h.M[name] != 0
+}
+
+func (p *PeerConn) sendExtendedMsg(extID byte, payload []byte) error {
+	msg := Message{
+		ID:      MsgExtended,
+		Payload: append([]byte{extID}, payload...),
+	}
+
+	return p.write(msg.Serialize())
+}
+
+func (p *PeerConn) SendExtendedHandshake() error {
+	h := extendedHandshake{
+		M:       extensions.localIDs(),
+		Version: clientVersion,
+		Port:    int(getTrackerPort()),
+		Reqq:    maxIncomingRequests,
+	}
+
+	if p.private {
+		// Peers of private torrents must only come from their trackers
+		delete(h.M, utPexExt)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, h); err != nil {
+		return fmt.Errorf("failed to marshal extended handshake: %w", err)
+	}
+
+	if err := p.sendExtendedMsg(extendedHandshakeID, buf.Bytes()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'extended handshake' message sent to peer %s", p.peer.String())
+
+	return nil
+}
+
+/*
+Sends a message of the given extension, using the ID the peer asked for
+*/
+func (p *PeerConn) SendExtensionMsg(name string, payload []byte) error {
+	h := p.extHandshake.Load()
+	if h == nil || h.M[name] == 0 {
+		return fmt.Errorf("peer doesn't support extension %s", name)
+	}
+
+	if err := p.sendExtendedMsg(byte(h.M[name]), payload); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message sent to peer %s", name, p.peer.String())
+
+	return nil
+}
+
+func (p *PeerConn) handleExtendedMsg(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty extended message")
+	}
+
+	extID := payload[0]
+	if extID == extendedHandshakeID {
+		h := extendedHandshake{}
+		if err := bencode.Unmarshal(bytes.NewReader(payload[1:]), &h); err != nil {
+			return fmt.Errorf("failed to parse extended handshake: %w", err)
+		}
+		p.extHandshake.Store(&h)
+		p.pipeline.setLimit(h.Reqq)
+
+		logger.LogRecvMessage("received 'extended handshake' from %s (client: '%s')", p.peer.String(), h.Version)
+		return nil
+	}
+
+	handler := extensions.handler(extID)
+	if handler == nil {
+		// Peers shouldn't send extensions we didn't advertise, but it's harmless
+		logger.LogRecvMessage("received unknown extended message %d from %s", extID, p.peer.String())
+		return nil
+	}
+
+	return handler(p, payload[1:])
+}
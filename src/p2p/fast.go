@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/TatuMon/bittorrent-client/logger"
+)
+
+/*
+Fast extension (BEP 6).
+
+It's enabled when both sides set its bit in the handshake. Then:
+  - The first message must be a bitfield, 'have all' or 'have none'.
+  - Requests that won't be served are answered with a 'reject request', instead of being silently dropped.
+    Choking no longer discards the pending requests, every one of them gets either the block or a reject.
+  - A peer may let us request some pieces even while choking us, with 'allowed fast'.
+  - 'suggest piece' hints at pieces the peer would rather send, usually ones it has cached.
+
+https://www.bittorrent.org/beps/bep_0006.html
+*/
+
+// More 'allowed fast' pieces than this are ignored. Peers usually allow around 10
+const maxAllowedFast = 64
+
+func (p *PeerConn) SupportsFast() bool {
+	return p.supportsFast
+}
+
+/*
+Pieces the peer lets us request while choking us
+*/
+func (p *PeerConn) AllowedFast() []int {
+	p.fastMu.Lock()
+	defer p.fastMu.Unlock()
+
+	pieces := make([]int, 0, len(p.allowedFast))
+	for index := range p.allowedFast {
+		pieces = append(pieces, index)
+	}
+
+	return pieces
+}
+
+func (p *PeerConn) SendHaveNone() error {
+	msg := Message{
+		ID: MsgHaveNone,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
+
+	return nil
+}
+
+func (p *PeerConn) sendRejectRequest(payload []byte) error {
+	msg := Message{
+		ID:      MsgRejectRequest,
+		Payload: payload,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message (piece %d, offset %d) sent to peer %s", msg.ID.String(), binary.BigEndian.Uint32(payload[0:4]), binary.BigEndian.Uint32(payload[4:8]), p.peer.String())
+
+	return nil
+}
+
+/*
+Sends the bitfield, or 'have none' if the peer expects one and we have nothing
+*/
+func (p *PeerConn) sendInitialBitfield(bitfield Bitfield) error {
+	if p.supportsFast && !bitfield.HasAny() {
+		return p.SendHaveNone()
+	}
+
+	return p.SendBitfield(bitfield)
+}
+
+func (p *PeerConn) setAllPieces(has bool) {
+	if p.bitfield == nil {
+		// Without a bitfield we don't track the peer's pieces
+		return
+	}
+
+	var b byte
+	if has {
+		// Spare bits get set too, but the pieces past the last one are never checked
+		b = 0xff
+	}
+	for i := range *p.bitfield {
+		(*p.bitfield)[i] = b
+	}
+
+	if o, ok := p.source.(PeerObserver); ok {
+		o.PeerBitfield(p, *p.bitfield)
+	}
+}
+
+func (p *PeerConn) handleFastMsg(msg *Message) error {
+	if !p.supportsFast {
+		return fmt.Errorf("received '%s' without negotiating the fast extension", msg.ID.String())
+	}
+
+	switch msg.ID {
+	case MsgHaveAll:
+		p.setAllPieces(true)
+	case MsgHaveNone:
+		p.setAllPieces(false)
+	case MsgSuggestPiece:
+		// Only a hint. Rarest first is kept
+		if len(msg.Payload) != 4 {
+			return errors.New("malformed 'suggest piece' message")
+		}
+	case MsgAllowedFast:
+		if len(msg.Payload) != 4 {
+			return errors.New("malformed 'allowed fast' message")
+		}
+
+		p.fastMu.Lock()
+		if len(p.allowedFast) < maxAllowedFast {
+			p.allowedFast[int(binary.BigEndian.Uint32(msg.Payload))] = struct{}{}
+		}
+		p.fastMu.Unlock()
+	case MsgRejectRequest:
+		if len(msg.Payload) != 12 {
+			return errors.New("malformed 'reject request' message")
+		}
+
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+		p.pipeline.requestCancelled(index, begin)
+
+		// The peer may reject allowed fast pieces too. Asking for them again would just get rejected
+		p.fastMu.Lock()
+		delete(p.allowedFast, int(index))
+		p.fastMu.Unlock()
+	}
+
+	return nil
+}
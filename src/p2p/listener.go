@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultListenPort = 6881
+
+// Port we accept peers on, reported to trackers and peers
+var listenPort atomic.Uint32
+
+type inboundTorrent struct {
+	torr   *torrent.Torrent
+	source PieceSource
+	conns  chan *PeerConn
+}
+
+/*
+Listener accepts connections from peers, for every torrent registered on it.
+*/
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[torrent.Sha1Checksum]*inboundTorrent
+}
+
+/*
+Starts accepting peers on the given port, which gets reported to trackers from then on.
+Peers can connect over both IPv4 and IPv6
+*/
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+
+	l := &Listener{
+		ln:       ln,
+		torrents: make(map[torrent.Sha1Checksum]*inboundTorrent),
+	}
+	listenPort.Store(uint32(ln.Addr().(*net.TCPAddr).Port))
+
+	go l.acceptLoop()
+
+	return l, nil
+}
+
+/*
+Peers that connect to us for this torrent are sent to the returned channel, which gets closed on Unregister
+*/
+func (l *Listener) Register(torr *torrent.Torrent, source PieceSource) <-chan *PeerConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := &inboundTorrent{
+		torr:   torr,
+		source: source,
+		conns:  make(chan *PeerConn, maxPeerConns),
+	}
+	l.torrents[torr.InfoHash] = t
+
+	return t.conns
+}
+
+func (l *Listener) Unregister(torr *torrent.Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t, ok := l.torrents[torr.InfoHash]; ok {
+		delete(l.torrents, torr.InfoHash)
+		close(t.conns)
+	}
+}
+
+/*
+Port the peers connect to us on
+*/
+func (l *Listener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logrus.Warnf("failed to accept peer: %s", err.Error())
+			continue
+		}
+
+		go func() {
+			if err := l.handleInbound(conn); err != nil {
+				logrus.Debugf("rejected peer %s: %s", conn.RemoteAddr().String(), err.Error())
+				conn.Close()
+			}
+		}()
+	}
+}
+
+/*
+The peer sends its handshake first. We only answer if it's for a torrent we have registered
+*/
+func (l *Listener) handleInbound(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	peerHandshake, err := HandshakeFromStream(buf)
+	if err != nil {
+		return fmt.Errorf("malformed handshake: %w", err)
+	}
+
+	l.mu.Lock()
+	t, ok := l.torrents[peerHandshake.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		return errors.New("handshake for an unknown torrent")
+	}
+
+	handshake := HandshakeFromTorrent(&torrent.Torrent{InfoHash: peerHandshake.InfoHash})
+	if handshake.PeerID == peerHandshake.PeerID {
+		return errors.New("connected to ourselves")
+	}
+
+	if _, err := conn.Write(handshake.Serialize()); err != nil {
+		return fmt.Errorf("failure at protocol handshake: %w", err)
+	}
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	peer := Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	pc, err := newPeerConn(t.torr, peer, conn, peerHandshake, t.source)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// It may have been unregistered in the meantime
+	if l.torrents[peerHandshake.InfoHash] != t {
+		return errors.New("torrent is no longer active")
+	}
+
+	select {
+	case t.conns <- pc:
+		logrus.Debugf("accepted peer %s", peer.String())
+		return nil
+	default:
+		return errors.New("too many incoming peers")
+	}
+}
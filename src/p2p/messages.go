@@ -31,6 +31,18 @@ func (m *MessageID) String() string {
 		return "cancel"
 	case MsgPort:
 		return "port"
+	case MsgSuggestPiece:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgRejectRequest:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
 	default:
 		return "unknown"
 	}
@@ -49,12 +61,24 @@ const (
 	MsgPort
 )
 
+// https://www.bittorrent.org/beps/bep_0006.html
+const (
+	MsgSuggestPiece MessageID = iota + 13
+	MsgHaveAll
+	MsgHaveNone
+	MsgRejectRequest
+	MsgAllowedFast
+)
+
+// https://www.bittorrent.org/beps/bep_0010.html
+const MsgExtended MessageID = 20
+
 type Message struct {
 	ID      MessageID
 	Payload []byte
 }
 
-/**
+/*
 BitTorrent messages follow the format: <lenght prefix><message ID><payload>
 where <lenght prefix> is 4 bytes long, <message ID> is a single byte long and <payload>'s lenght
 is equal to <length prefix> - 1
@@ -73,7 +97,7 @@ func (m *Message) Serialize() []byte {
 	return buf.Bytes()
 }
 
-/**
+/*
 BitTorrent messages follow the format: <lenght prefix><message ID><payload>
 where <lenght prefix> is 4 bytes long, <message ID> is a single byte long and <payload>'s lenght
 is equal to <length prefix> - 1
@@ -97,7 +121,7 @@ func MessageFromStream(d io.Reader) (*Message, error) {
 	}
 
 	m := Message{
-		ID: MessageID(msgBuf[0]),
+		ID:      MessageID(msgBuf[0]),
 		Payload: msgBuf[1:],
 	}
 
@@ -106,16 +130,38 @@ func MessageFromStream(d io.Reader) (*Message, error) {
 
 type Bitfield []byte
 
+func NewBitfield(totalPieces int) Bitfield {
+	return make(Bitfield, (totalPieces+7)/8)
+}
+
 func (b Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	bitIndex := index - (8 * byteIndex)
 
-	return b[byteIndex]&(1<<(7 - bitIndex)) != 0
+	if index < 0 || byteIndex >= len(b) {
+		return false
+	}
+
+	return b[byteIndex]&(1<<(7-bitIndex)) != 0
 }
 
 func (b Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
 	bitIndex := index - (8 * byteIndex)
 
-	b[byteIndex] |= (1<<(7 - bitIndex))
+	if index < 0 || byteIndex >= len(b) {
+		return
+	}
+
+	b[byteIndex] |= (1 << (7 - bitIndex))
+}
+
+func (b Bitfield) HasAny() bool {
+	for _, by := range b {
+		if by != 0 {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,275 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"github.com/TatuMon/bittorrent-client/logger"
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Fetching the metadata of a magnet link relies on ut_metadata (BEP 9), an extension of the extension protocol.
+
+https://www.bittorrent.org/beps/bep_0009.html
+*/
+
+const utMetadataExt = "ut_metadata"
+
+const metadataPieceSize = 16 * 1024
+const maxMetadataSize = 32 * 1024 * 1024
+
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size"`
+}
+
+/*
+State of the metadata download from a single peer
+*/
+type metadataFetch struct {
+	metadata []byte
+	received []bool
+	missing  int
+	err      error
+}
+
+func init() {
+	RegisterExtension(utMetadataExt, handleMetadataMsg)
+}
+
+func (p *PeerConn) sendMetadataMsg(msgType int, piece int) error {
+	buf := new(bytes.Buffer)
+	msg := map[string]int{"msg_type": msgType, "piece": piece}
+	if err := bencode.Marshal(buf, msg); err != nil {
+		return fmt.Errorf("failed to marshal ut_metadata message: %w", err)
+	}
+
+	return p.SendExtensionMsg(utMetadataExt, buf.Bytes())
+}
+
+func handleMetadataMsg(p *PeerConn, payload []byte) error {
+	rawDict, data, err := torrent.SplitBencodeValue(payload)
+	if err != nil {
+		return fmt.Errorf("malformed ut_metadata message: %w", err)
+	}
+
+	m := metadataMsg{}
+	if err := bencode.Unmarshal(bytes.NewReader(rawDict), &m); err != nil {
+		return fmt.Errorf("failed to parse ut_metadata message: %w", err)
+	}
+	logger.LogRecvMessage("received 'ut_metadata' of type %d for piece %d from %s", m.MsgType, m.Piece, p.peer.String())
+
+	fetch := p.metadataFetch
+
+	switch m.MsgType {
+	case metadataRequest:
+		// We don't keep the raw metadata around, so we can't serve it
+		return p.sendMetadataMsg(metadataReject, m.Piece)
+	case metadataReject:
+		if fetch != nil {
+			fetch.err = fmt.Errorf("peer rejected metadata piece %d", m.Piece)
+		}
+	case metadataData:
+		if fetch == nil || fetch.metadata == nil {
+			return nil
+		}
+
+		if m.Piece < 0 || m.Piece >= len(fetch.received) {
+			fetch.err = fmt.Errorf("received out of range metadata piece %d", m.Piece)
+			return nil
+		}
+
+		begin := m.Piece * metadataPieceSize
+		expectedLen := min(metadataPieceSize, len(fetch.metadata)-begin)
+		if len(data) != expectedLen {
+			fetch.err = fmt.Errorf("metadata piece %d has length %d, expected %d", m.Piece, len(data), expectedLen)
+			return nil
+		}
+
+		copy(fetch.metadata[begin:], data)
+		if !fetch.received[m.Piece] {
+			fetch.received[m.Piece] = true
+			fetch.missing--
+		}
+	}
+
+	return nil
+}
+
+/*
+Once the peer's extended handshake arrives, we know the metadata size and can request every piece of it
+*/
+func (p *PeerConn) requestMetadata() error {
+	if !p.SupportsExtension(utMetadataExt) {
+		return errors.New("peer doesn't support ut_metadata")
+	}
+
+	size := p.extHandshake.Load().MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	fetch := p.metadataFetch
+	fetch.metadata = make([]byte, size)
+	fetch.missing = (size + metadataPieceSize - 1) / metadataPieceSize
+	fetch.received = make([]bool, fetch.missing)
+
+	for i := range fetch.missing {
+		if err := p.sendMetadataMsg(metadataRequest, i); err != nil {
+			return fmt.Errorf("failed to request metadata piece %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func fetchMetadataFromPeer(torr *torrent.Torrent, peer Peer, workCtx context.Context) ([]byte, error) {
+	pc, err := dialPeer(torr, peer, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.CloseConn()
+
+	stop := context.AfterFunc(workCtx, func() { pc.CloseConn() })
+	defer stop()
+
+	if !pc.SupportsExtensions() {
+		return nil, errors.New("peer doesn't support the extension protocol")
+	}
+
+	pc.metadataFetch = &metadataFetch{}
+	fetch := pc.metadataFetch
+
+	for {
+		if _, err := pc.Read(); err != nil {
+			return nil, err
+		}
+
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+
+		if fetch.metadata == nil {
+			if pc.extHandshake.Load() == nil {
+				continue
+			}
+
+			if err := pc.requestMetadata(); err != nil {
+				return nil, err
+			}
+		}
+
+		if fetch.missing == 0 {
+			if sha1.Sum(fetch.metadata) != torr.InfoHash {
+				return nil, errors.New("metadata doesn't match the info hash")
+			}
+
+			return fetch.metadata, nil
+		}
+	}
+}
+
+/*
+Asks every peer for the torrent's metadata at the same time, returning the first one that matches the info hash.
+*/
+func FetchMetadata(torr *torrent.Torrent, peers []Peer, workCtx context.Context) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch the metadata from")
+	}
+
+	fetchCtx, fetchCtxCancel := context.WithCancel(workCtx)
+	defer fetchCtxCancel()
+
+	type result struct {
+		metadata []byte
+		err      error
+	}
+	results := make(chan result, len(peers))
+
+	for _, p := range peers {
+		peer := p
+		go func() {
+			metadata, err := fetchMetadataFromPeer(torr, peer, fetchCtx)
+			if err != nil {
+				logrus.Debugf("failed to fetch metadata from peer %s: %s", peer.String(), err.Error())
+			}
+			results <- result{metadata, err}
+		}()
+	}
+
+	for range peers {
+		select {
+		case <-workCtx.Done():
+			return nil, workCtx.Err()
+		case r := <-results:
+			if r.err == nil {
+				return r.metadata, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no peer could provide the metadata")
+}
+
+/*
+PeerFinder looks up the peers of a torrent by its info hash, like the DHT does
+*/
+type PeerFinder func(ctx context.Context, infoHash [20]byte) ([]Peer, error)
+
+/*
+Gathers peers from the magnet's direct peers, its trackers and findPeers, if not nil, then fetches the
+metadata from them. The peers are returned too, so the download can start with them
+*/
+func TorrentFromMagnet(m *torrent.Magnet, findPeers PeerFinder, workCtx context.Context) (*torrent.Torrent, []Peer, error) {
+	peers := make([]Peer, 0, len(m.Peers))
+	for _, addr := range m.Peers {
+		peer, err := PeerFromAddr(addr)
+		if err != nil {
+			logrus.Warnf("ignoring magnet peer %s: %s", addr, err.Error())
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	partial := m.PartialTorrent()
+	if len(partial.AnnounceList) > 0 {
+		trackerPeers, err := Announce(partial)
+		if err != nil {
+			logrus.Warnf("failed to get peers from trackers: %s", err.Error())
+		}
+		peers = append(peers, trackerPeers...)
+	}
+
+	if findPeers != nil {
+		found, err := findPeers(workCtx, partial.InfoHash)
+		if err != nil {
+			logrus.Warnf("failed to find peers: %s", err.Error())
+		}
+		peers = append(peers, found...)
+	}
+
+	rawInfo, err := FetchMetadata(partial, peers, workCtx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+
+	torr, err := torrent.TorrentFromMetadata(m, rawInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return torr, peers, nil
+}
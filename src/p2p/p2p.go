@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,6 +23,9 @@ import (
 const handshakeLen = 68
 const MaxReqBacklog = 5
 
+// Maximum amount of peers we are connected, or trying to connect, to at the same time
+const maxPeerConns = 50
+
 /*
 The user is also a peer. This is his ID
 
@@ -52,11 +56,42 @@ func getClientPeerID() string {
 
 type Peer struct {
 	IP   net.IP
+	Host string // Domain name the tracker gave instead of the IP, resolved when connecting. IP is nil until then
 	Port uint16
+	ID   string // Peer ID the tracker gave, if any. The peer must send the same one in its handshake
 }
 
+/*
+"ip:port", with IPv6 addresses in brackets. "host:port" if the peer's domain name isn't resolved yet
+*/
 func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	if p.IP == nil && p.Host != "" {
+		return net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port)))
+	}
+
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+/*
+Parses a "host:port" address, like the ones found in magnet links. The host may be a domain name
+*/
+func PeerFromAddr(addr string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, fmt.Errorf("malformed address: %w", err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Peer{}, fmt.Errorf("malformed port: %w", err)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return Peer{}, fmt.Errorf("failed to resolve host %s: %w", host, err)
+	}
+
+	return Peer{IP: ips[0], Port: uint16(port)}, nil
 }
 
 func (p *Peer) PrintJson() {
@@ -68,13 +103,7 @@ func (p *Peer) PrintJson() {
 The peers are defined by 6-byte strings, where the first 4 define the IP and the last 2 the port.
 Both using network byte order (big-endian)
 */
-func peersFromTrackerResponse(t *trackerResponse) ([]Peer, error) {
-	peersBin := []byte(t.Peers)
-
-	if len(peersBin) == 0 {
-		return nil, errors.New("tracker response doesn't contain peers")
-	}
-
+func peersFromCompact(peersBin []byte) ([]Peer, error) {
 	const chunkSize = 6 // 6 bytes per peer
 	totalPeers := len(peersBin) / 6
 	if len(peersBin)%chunkSize != 0 {
@@ -91,6 +120,37 @@ func peersFromTrackerResponse(t *trackerResponse) ([]Peer, error) {
 	return peers, nil
 }
 
+/*
+Same as peersFromCompact, for IPv6 peers: 16 bytes for the IP and 2 for the port
+*/
+func peersFromCompact6(peersBin []byte) ([]Peer, error) {
+	const chunkSize = 18
+	if len(peersBin)%chunkSize != 0 {
+		return nil, errors.New("received malformed peers")
+	}
+
+	peers := make([]Peer, len(peersBin)/chunkSize)
+	for i := range peers {
+		offset := i * chunkSize
+		peers[i].IP = peersBin[offset : offset+16]
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+
+	return peers, nil
+}
+
+/*
+Trackers send IPv4 peers in 'peers' and IPv6 ones in 'peers6' (BEP 7)
+*/
+func peersFromTrackerResponse(t *trackerResponse) ([]Peer, error) {
+	peers6, err := peersFromCompact6([]byte(t.Peers6))
+	if err != nil {
+		return nil, fmt.Errorf("malformed 'peers6': %w", err)
+	}
+
+	return append(t.PeerList, peers6...), nil
+}
+
 func PrintPeersJson(peers []Peer) {
 	for _, peer := range peers {
 		peer.PrintJson()
@@ -99,6 +159,7 @@ func PrintPeersJson(peers []Peer) {
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // Each bit advertises support for a protocol extension
 	InfoHash torrent.Sha1Checksum
 	PeerID   torrent.Sha1Checksum
 }
@@ -109,23 +170,40 @@ https://wiki.theory.org/BitTorrentSpecification#Handshake
 */
 func (h *Handshake) Serialize() []byte {
 	var buf bytes.Buffer
-	var reserved [8]byte
 
 	buf.WriteByte(byte(len(h.Pstr)))
 	buf.Write([]byte("BitTorrent protocol"))
-	buf.Write(reserved[:])
+	buf.Write(h.Reserved[:])
 	buf.Write(h.InfoHash[:])
 	buf.Write(h.PeerID[:])
 
 	return buf.Bytes()
 }
 
+/*
+Extension protocol (BEP 10): 20th bit from the right
+*/
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+/*
+Fast extension (BEP 6): 3rd bit from the right
+*/
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&0x04 != 0
+}
+
 func HandshakeFromTorrent(torr *torrent.Torrent) Handshake {
-	return Handshake{
+	h := Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: torr.InfoHash,
 		PeerID:   torrent.Sha1Checksum([]byte(getClientPeerID())),
 	}
+	h.Reserved[5] |= 0x10
+	h.Reserved[7] |= 0x04
+
+	return h
 }
 
 func HandshakeFromStream(r []byte) (*Handshake, error) {
@@ -142,7 +220,10 @@ func HandshakeFromStream(r []byte) (*Handshake, error) {
 		return nil, fmt.Errorf("failed to get protocol string: %w", err)
 	}
 
-	buf.Next(8) // Discard the "reserved" part of the handshake
+	var reserved [8]byte
+	if _, err := io.ReadFull(buf, reserved[:]); err != nil {
+		return nil, fmt.Errorf("failed to get reserved bytes: %w", err)
+	}
 
 	infoHashBuf := make([]byte, 20)
 	if _, err := io.ReadFull(buf, infoHashBuf); err != nil {
@@ -156,30 +237,80 @@ func HandshakeFromStream(r []byte) (*Handshake, error) {
 
 	return &Handshake{
 		Pstr:     string(pstrbuf),
+		Reserved: reserved,
 		InfoHash: torrent.Sha1Checksum(infoHashBuf),
 		PeerID:   torrent.Sha1Checksum(peerIDBuf),
 	}, nil
 }
 
 type PeerConn struct {
-	peer       Peer
-	conn       net.Conn
-	unchoked   bool
-	interested bool
-	ReqBacklog int
-	bitfield   *Bitfield
+	peer     Peer
+	conn     net.Conn
+	bitfield *Bitfield
+
+	// Both sides start choking and not interested. Messages may be read and sent from several goroutines
+	amChoking      atomic.Bool
+	amInterested   atomic.Bool
+	peerChoking    atomic.Bool
+	peerInterested atomic.Bool
+	interestMu     sync.Mutex // Keeps amInterested in line with the last message sent
+
+	downloaded atomic.Uint64 // Bytes of piece data received from the peer
+	uploaded   atomic.Uint64 // Bytes of piece data sent to the peer
+
+	pipeline *requestPipeline
+
+	supportsFast bool
+	fastMu       sync.Mutex
+	allowedFast  map[int]struct{} // Pieces we may request while choked
+
+	outbound  bool      // We connected to the peer, so it's listening on its address
+	private   bool      // The torrent is private, so peers must not be exchanged with it
+	pexRecvAt time.Time // When its last ut_pex message arrived
+
+	supportsExtensions bool
+	extHandshake       atomic.Pointer[extendedHandshake] // nil until the peer sends its extended handshake
+	metadataFetch      *metadataFetch
+
+	source PieceSource // nil if we don't serve pieces to this peer
+
+	writeMu   sync.Mutex // Messages may be sent from several goroutines
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (p *PeerConn) GetPeer() Peer {
 	return p.peer
 }
 
+/*
+Reports whether the peer lets us request pieces from it
+*/
 func (p *PeerConn) IsUnchoked() bool {
-	return p.unchoked
+	return !p.peerChoking.Load()
 }
 
-func (p *PeerConn) IsInterested() bool {
-	return p.interested
+/*
+Reports whether the peer wants pieces from us
+*/
+func (p *PeerConn) PeerInterested() bool {
+	return p.peerInterested.Load()
+}
+
+func (p *PeerConn) AmChoking() bool {
+	return p.amChoking.Load()
+}
+
+func (p *PeerConn) AmInterested() bool {
+	return p.amInterested.Load()
+}
+
+func (p *PeerConn) Downloaded() uint64 {
+	return p.downloaded.Load()
+}
+
+func (p *PeerConn) Uploaded() uint64 {
+	return p.uploaded.Load()
 }
 
 func (p *PeerConn) GetBitfield() *Bitfield {
@@ -187,12 +318,41 @@ func (p *PeerConn) GetBitfield() *Bitfield {
 }
 
 func (p *PeerConn) CloseConn() error {
+	p.closeOnce.Do(func() { close(p.closed) })
 	return p.conn.Close()
 }
 
+/*
+Gets closed once CloseConn is called
+*/
+func (p *PeerConn) Closed() <-chan struct{} {
+	return p.closed
+}
+
+/*
+Writes the whole data to the connection, without interleaving it with other goroutines' writes
+*/
+func (p *PeerConn) write(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	defer p.conn.SetWriteDeadline(time.Time{})
+
+	if _, err := p.conn.Write(data); err != nil {
+		return fmt.Errorf("failed to write to connection: %w", err)
+	}
+
+	return nil
+}
+
 func (p *PeerConn) Read() (*Message, error) {
-	p.conn.SetDeadline(time.Now().Add(time.Second * 60))
-	defer p.conn.SetDeadline(time.Time{})
+	return p.ReadTimeout(60 * time.Second)
+}
+
+func (p *PeerConn) ReadTimeout(timeout time.Duration) (*Message, error) {
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer p.conn.SetReadDeadline(time.Time{})
 
 	msg, err := MessageFromStream(p.conn)
 	if err != nil {
@@ -208,16 +368,54 @@ func (p *PeerConn) Read() (*Message, error) {
 
 	switch msg.ID {
 	case MsgChoke:
-		p.unchoked = false
+		p.peerChoking.Store(true)
+		if !p.supportsFast {
+			p.pipeline.choked()
+		}
 	case MsgUnchoke:
-		p.unchoked = true
+		p.peerChoking.Store(false)
+	case MsgInterested, MsgNotInterested:
+		p.peerInterested.Store(msg.ID == MsgInterested)
+		if o, ok := p.source.(PeerObserver); ok {
+			o.PeerInterestChanged(p)
+		}
 	case MsgBitField:
 		p.bitfield = (*Bitfield)(&msg.Payload)
+		if o, ok := p.source.(PeerObserver); ok {
+			o.PeerBitfield(p, *p.bitfield)
+		}
 	case MsgHave:
+		if len(msg.Payload) != 4 {
+			return nil, errors.New("malformed 'have' message")
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload))
 		if p.bitfield != nil {
-			p.bitfield.SetPiece(int(binary.BigEndian.Uint32(msg.Payload)))
+			p.bitfield.SetPiece(index)
+		}
+		if o, ok := p.source.(PeerObserver); ok {
+			o.PeerHave(p, index)
 		}
-	// I dont expect to receive other type of messages
+	case MsgPiece:
+		if len(msg.Payload) >= 8 {
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			p.pipeline.blockReceived(index, begin, len(msg.Payload)-8)
+			p.downloaded.Add(uint64(len(msg.Payload) - 8))
+		}
+	case MsgRequest:
+		if err := p.handleRequest(msg.Payload); err != nil {
+			return nil, fmt.Errorf("failed to serve request: %w", err)
+		}
+	case MsgSuggestPiece, MsgHaveAll, MsgHaveNone, MsgRejectRequest, MsgAllowedFast:
+		if err := p.handleFastMsg(msg); err != nil {
+			return nil, err
+		}
+	case MsgExtended:
+		if err := p.handleExtendedMsg(msg.Payload); err != nil {
+			return nil, fmt.Errorf("failed to handle extended message: %w", err)
+		}
+	default:
+		// I dont expect to receive other type of messages
 	}
 
 	return msg, nil
@@ -228,9 +426,28 @@ func (p *PeerConn) SendInterestedMsg() error {
 		ID: MsgInterested,
 	}
 
-	m := msg.Serialize()
-	if _, err := p.conn.Write(m); err != nil {
-		return fmt.Errorf("failed to write to connection: %w", err)
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+	p.amInterested.Store(true)
+
+	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
+
+	return nil
+}
+
+/*
+Stops serving the peer. Its pending requests are dropped, as the peer must send them again once unchoked
+*/
+func (p *PeerConn) SendChoke() error {
+	msg := Message{
+		ID: MsgChoke,
+	}
+
+	// Set before sending, so no block gets sent after the choke
+	p.amChoking.Store(true)
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
 	}
 
 	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
@@ -238,15 +455,50 @@ func (p *PeerConn) SendInterestedMsg() error {
 	return nil
 }
 
+func (p *PeerConn) SendNotInterestedMsg() error {
+	msg := Message{
+		ID: MsgNotInterested,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+	p.amInterested.Store(false)
+
+	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
+
+	return nil
+}
+
+/*
+Sends 'interested' or 'not interested' if wants disagrees with what the peer was told last.
+wants is called with the peer's interest locked, so concurrent updates can't be sent out of order
+*/
+func (p *PeerConn) UpdateInterest(wants func() bool) error {
+	p.interestMu.Lock()
+	defer p.interestMu.Unlock()
+
+	interested := wants()
+	if interested == p.AmInterested() {
+		return nil
+	}
+
+	if interested {
+		return p.SendInterestedMsg()
+	}
+
+	return p.SendNotInterestedMsg()
+}
+
 func (p *PeerConn) SendUnchoke() error {
 	msg := Message{
 		ID: MsgUnchoke,
 	}
 
-	m := msg.Serialize()
-	if _, err := p.conn.Write(m); err != nil {
-		return fmt.Errorf("failed to write to connection: %w", err)
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
 	}
+	p.amChoking.Store(false)
 
 	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
 
@@ -260,23 +512,48 @@ func (p *PeerConn) SendRequestMsg(pieceIndex uint32, beginOffset uint32, blockLe
 	binary.BigEndian.PutUint32(payloadBuf[8:12], blockLen)
 
 	msg := Message{
-		ID: MsgRequest,
+		ID:      MsgRequest,
 		Payload: payloadBuf,
 	}
 
-	m := msg.Serialize()
-	if _, err := p.conn.Write(m); err != nil {
-		return fmt.Errorf("failed to write to connection: %w", err)
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
 	}
+	p.pipeline.requestSent(pieceIndex, beginOffset)
 
 	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
 
 	return nil
 }
 
+/*
+Withdraws a request sent before. The peer may have sent the block already
+*/
+func (p *PeerConn) SendCancelMsg(pieceIndex uint32, beginOffset uint32, blockLen uint32) error {
+	payloadBuf := make([]byte, 12)
+	binary.BigEndian.PutUint32(payloadBuf[0:4], pieceIndex)
+	binary.BigEndian.PutUint32(payloadBuf[4:8], beginOffset)
+	binary.BigEndian.PutUint32(payloadBuf[8:12], blockLen)
+
+	msg := Message{
+		ID:      MsgCancel,
+		Payload: payloadBuf,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+	p.pipeline.requestCancelled(pieceIndex, beginOffset)
+
+	logger.LogSentMessage("'%s' message (piece %d, offset %d) sent to peer %s", msg.ID.String(), pieceIndex, beginOffset, p.peer.String())
+
+	return nil
+}
+
 func (p *PeerConn) SendKeepAlive() error {
-	if _, err := p.conn.Write(nil); err != nil {
-		return fmt.Errorf("failed to write to connection: %w", err)
+	// A keep alive is just a zero length prefix
+	if err := p.write(make([]byte, 4)); err != nil {
+		return err
 	}
 
 	logger.LogSentMessage("'keep alive' message sent to peer %s", p.peer.String())
@@ -284,7 +561,55 @@ func (p *PeerConn) SendKeepAlive() error {
 	return nil
 }
 
-func connectToPeer(torr *torrent.Torrent, peer Peer) (*PeerConn, error) {
+/*
+Builds the connection once the handshakes were exchanged, and sends the messages that must go right after them:
+our bitfield, if there's anything to serve or the peer supports the fast extension, and the extended handshake,
+if the peer supports it.
+*/
+func newPeerConn(torr *torrent.Torrent, peer Peer, conn net.Conn, peerHandshake *Handshake, source PieceSource) (*PeerConn, error) {
+	pc := &PeerConn{
+		peer:               peer,
+		conn:               conn,
+		private:            torr.Private,
+		supportsFast:       peerHandshake.SupportsFast(),
+		allowedFast:        make(map[int]struct{}),
+		supportsExtensions: peerHandshake.SupportsExtensions(),
+		source:             source,
+		pipeline:           newRequestPipeline(),
+		closed:             make(chan struct{}),
+	}
+	pc.amChoking.Store(true)
+	pc.peerChoking.Store(true)
+
+	if source != nil {
+		// Peers with nothing may skip their bitfield, but we still need to track their 'have' messages
+		pc.bitfield = new(Bitfield)
+		*pc.bitfield = make(Bitfield, len(source.Bitfield()))
+
+		if err := pc.sendInitialBitfield(source.Bitfield()); err != nil {
+			return nil, fmt.Errorf("failed to send bitfield: %w", err)
+		}
+	} else if pc.supportsFast {
+		if err := pc.SendHaveNone(); err != nil {
+			return nil, fmt.Errorf("failed to send bitfield: %w", err)
+		}
+	}
+
+	if pc.supportsExtensions {
+		if err := pc.SendExtendedHandshake(); err != nil {
+			return nil, fmt.Errorf("failure at extended handshake: %w", err)
+		}
+	}
+
+	return pc, nil
+}
+
+/*
+Makes the TCP connection and the protocol handshake, including the extended one if the peer supports it.
+
+source may be nil if we don't serve pieces to the peer
+*/
+func dialPeer(torr *torrent.Torrent, peer Peer, source PieceSource) (*PeerConn, error) {
 	conn, err := net.DialTimeout("tcp", peer.String(), 30*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make TCP connection: %w", err)
@@ -292,6 +617,11 @@ func connectToPeer(torr *torrent.Torrent, peer Peer) (*PeerConn, error) {
 	conn.SetDeadline(time.Now().Add(30 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && peer.IP == nil {
+		// The dial resolved the peer's domain name
+		peer.IP = addr.IP
+	}
+
 	handshake := HandshakeFromTorrent(torr)
 	if _, err := conn.Write(handshake.Serialize()); err != nil {
 		conn.Close()
@@ -299,7 +629,7 @@ func connectToPeer(torr *torrent.Torrent, peer Peer) (*PeerConn, error) {
 	}
 
 	res := make([]byte, handshakeLen)
-	if _, err := conn.Read(res); err != nil {
+	if _, err := io.ReadFull(conn, res); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to read peer's handshake response: %w", err)
 	}
@@ -314,80 +644,104 @@ func connectToPeer(torr *torrent.Torrent, peer Peer) (*PeerConn, error) {
 		return nil, errors.New("handshake failure: info hashes dont match")
 	}
 
-	pc := &PeerConn{
-		peer:       peer,
-		conn:       conn,
-		unchoked:   false,
-		interested: false,
+	if handshake.PeerID == handshakeRes.PeerID {
+		conn.Close()
+		return nil, errors.New("handshake failure: connected to ourselves")
 	}
 
-	for !pc.unchoked {
-		_, err := pc.Read()
-		if err != nil {
-			return nil, fmt.Errorf("failed to wait for bitfield: %w", err)
-		}
+	if peer.ID != "" && peer.ID != string(handshakeRes.PeerID[:]) {
+		conn.Close()
+		return nil, errors.New("handshake failure: peer ID doesn't match the one the tracker gave")
 	}
 
+	pc, err := newPeerConn(torr, peer, conn, handshakeRes, source)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pc.outbound = true
+
 	return pc, nil
 }
 
 /*
-If workCtx is done, the channel is not yet closed, but no more peers are added to it from this function.
+Connects to every peer received through peers, skipping the ones we are already connected to.
+Once a connection gets closed, the peer may be connected to again if it's received later.
+
+The returned channel is closed once workCtx is done.
 */
-func ConnectPeersAsync(torr *torrent.Torrent, peers []Peer, workCtx context.Context) chan *PeerConn {
-	channel := make(chan *PeerConn, len(peers))
-	peersConnectedTotal := atomic.Uint64{}
-	connsAttempts := atomic.Uint64{}
-	totalPeers := len(peers)
+func ConnectPeersAsync(torr *torrent.Torrent, peers <-chan []Peer, source PieceSource, workCtx context.Context) chan *PeerConn {
+	channel := make(chan *PeerConn, maxPeerConns)
+
+	var activeMu sync.Mutex
+	active := make(map[string]struct{}) // Peers being connected to, or already connected
+	release := func(addr string) {
+		activeMu.Lock()
+		delete(active, addr)
+		activeMu.Unlock()
+	}
 
-	peersConnsWorkCtx, peersConnsWorkCtxCancel := context.WithCancel(workCtx)
+	var dialing sync.WaitGroup
 
-	// Channel cleanup
 	go func() {
-		closing := sync.OnceFunc(func() { close(channel) })
-
-		// "channel" should be closed here when either workCtx is done or all peers are processed
-		select {
-		case <-workCtx.Done():
-			peersConnsWorkCtxCancel()
-			closing()
-			return
-		case <-peersConnsWorkCtx.Done():
-			closing()
-			logrus.Debug("connected to all available peers")
-			return
-		}
-	}()
-
-	for _, p := range peers {
-		peer := p
-		go func() {
-			defer func() {
-				connsAttempts.Add(1)
-				if connsAttempts.Load() == uint64(totalPeers) {
-					peersConnsWorkCtxCancel()
-				}
-			}()
-
-			pConn, err := connectToPeer(torr, peer)
-			if err != nil {
-				logrus.Warnf("failed to connect to peer %s: %s", peer.String(), err.Error())
-				return
-			}
+		// "channel" must only be closed once no one else can write to it
+		defer func() {
+			dialing.Wait()
+			close(channel)
+		}()
 
+		for {
+			var batch []Peer
 			select {
 			case <-workCtx.Done():
 				return
-			case channel <- pConn:
-				peersConnectedTotal.Add(1)
-				logrus.Debugf("%d/%d peers connected", peersConnectedTotal.Load(), totalPeers)
+			case batch = <-peers:
 			}
-		}()
-	}
 
-	if totalPeers == 0 {
-		peersConnsWorkCtxCancel()
-	}
+			for _, p := range batch {
+				peer := p
+				addr := peer.String()
+
+				activeMu.Lock()
+				_, known := active[addr]
+				full := len(active) >= maxPeerConns
+				if !known && !full {
+					active[addr] = struct{}{}
+				}
+				activeMu.Unlock()
+
+				if known || full {
+					continue
+				}
+
+				dialing.Add(1)
+				go func() {
+					defer dialing.Done()
+
+					pConn, err := dialPeer(torr, peer, source)
+					if err != nil {
+						logrus.Warnf("failed to connect to peer %s: %s", addr, err.Error())
+						release(addr)
+						return
+					}
+
+					select {
+					case <-workCtx.Done():
+						pConn.CloseConn()
+						release(addr)
+						return
+					case channel <- pConn:
+						logrus.Debugf("connected to peer %s", addr)
+					}
+
+					go func() {
+						<-pConn.Closed()
+						release(addr)
+					}()
+				}()
+			}
+		}
+	}()
 
 	return channel
 }
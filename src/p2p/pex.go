@@ -0,0 +1,323 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/logger"
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Peer exchange (BEP 11), an extension of the extension protocol.
+
+Connected peers tell each other which peers they connected to, and which ones they dropped, since their
+last message. It lets a swarm keep growing even when the trackers are down.
+
+https://www.bittorrent.org/beps/bep_0011.html
+*/
+
+const utPexExt = "ut_pex"
+
+// Peers must not send PEX messages more often than this
+const pexInterval = time.Minute
+
+// Messages arriving a bit early are still accepted, as the sender's timer may not be exact
+const pexMinRecvInterval = 50 * time.Second
+
+// Most peers listed as added, and as dropped, in a single message
+const maxPexPeers = 50
+
+// Flags sent for each added peer
+const (
+	pexSeed      = 0x02 // It has every piece
+	pexReachable = 0x10 // We connected to it, so it accepts incoming connections
+)
+
+type pexMsg struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+/*
+PexObserver gets the peers learnt through PEX.
+If the PieceSource given to a connection implements it, it gets the peers that connection tells us about.
+*/
+type PexObserver interface {
+	PeersExchanged(p *PeerConn, added []Peer)
+}
+
+func init() {
+	RegisterExtension(utPexExt, handlePexMsg)
+}
+
+func handlePexMsg(p *PeerConn, payload []byte) error {
+	if p.private {
+		logger.LogRecvMessage("ignoring 'ut_pex' from %s, the torrent is private", p.peer.String())
+		return nil
+	}
+
+	m := pexMsg{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &m); err != nil {
+		return fmt.Errorf("failed to parse ut_pex message: %w", err)
+	}
+
+	now := time.Now()
+	if !p.pexRecvAt.IsZero() && now.Sub(p.pexRecvAt) < pexMinRecvInterval {
+		logger.LogRecvMessage("ignoring 'ut_pex' from %s, sent too soon after the last one", p.peer.String())
+		return nil
+	}
+	p.pexRecvAt = now
+
+	added, err := peersFromCompact([]byte(m.Added))
+	if err != nil {
+		return fmt.Errorf("malformed ut_pex 'added': %w", err)
+	}
+	added6, err := peersFromCompact6([]byte(m.Added6))
+	if err != nil {
+		return fmt.Errorf("malformed ut_pex 'added6': %w", err)
+	}
+
+	// Dropped peers are only informative. Peers we are connected to are kept
+	peers := append(added[:min(len(added), maxPexPeers)], added6[:min(len(added6), maxPexPeers)]...)
+	logger.LogRecvMessage("received 'ut_pex' with %d peers from %s", len(peers), p.peer.String())
+
+	if o, ok := p.source.(PexObserver); ok && len(peers) > 0 {
+		o.PeersExchanged(p, peers)
+	}
+
+	return nil
+}
+
+/*
+The address other peers can connect to the peer on. For peers that connected to us, it's only known
+if they sent their listening port in the extended handshake
+*/
+func (p *PeerConn) listenAddr() (Peer, bool) {
+	if p.outbound {
+		return p.peer, true
+	}
+
+	h := p.extHandshake.Load()
+	if h == nil || h.Port <= 0 || h.Port > 65535 {
+		return Peer{}, false
+	}
+
+	return Peer{IP: p.peer.IP, Port: uint16(h.Port)}, true
+}
+
+/*
+Appends the peer in the compact form used by trackers: the IP followed by the port, in network byte order
+*/
+func appendCompactPeer(b []byte, ip net.IP, port uint16) []byte {
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+type pexPeer struct {
+	peer  Peer
+	flags byte
+}
+
+/*
+PeerExchange sends ut_pex messages to the peers of a torrent, telling each one the changes in our
+connections since its last message. It also passes the peers learnt through PEX on to the peers channel.
+*/
+type PeerExchange struct {
+	found  chan<- []Peer
+	isSeed func(p *PeerConn) bool
+
+	mu    sync.Mutex
+	conns map[*PeerConn]map[string]pexPeer // Peers already sent to each connection
+	queue []Peer                           // Peers learnt, waiting to be sent to found
+	wake  chan struct{}
+}
+
+/*
+found gets every batch of peers learnt from other peers. isSeed reports whether a peer has every piece
+*/
+func NewPeerExchange(found chan<- []Peer, isSeed func(p *PeerConn) bool) *PeerExchange {
+	return &PeerExchange{
+		found:  found,
+		isSeed: isSeed,
+		conns:  make(map[*PeerConn]map[string]pexPeer),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (x *PeerExchange) AddPeer(p *PeerConn) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.conns[p] = make(map[string]pexPeer)
+}
+
+func (x *PeerExchange) RemovePeer(p *PeerConn) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.conns, p)
+}
+
+/*
+Queues the peers to be sent to the peers channel. It never blocks
+*/
+func (x *PeerExchange) Found(peers []Peer) {
+	x.mu.Lock()
+	x.queue = append(x.queue, peers...)
+	x.mu.Unlock()
+
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Sends our PEX messages every minute, and the peers learnt as they arrive, until ctx is done
+*/
+func (x *PeerExchange) Run(ctx context.Context) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.sendAll()
+		case <-x.wake:
+			x.mu.Lock()
+			peers := x.queue
+			x.queue = nil
+			x.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case x.found <- peers:
+			}
+		}
+	}
+}
+
+/*
+The peers we are connected to that others can connect to, keyed by address
+*/
+func (x *PeerExchange) connected() map[string]pexPeer {
+	peers := make(map[string]pexPeer, len(x.conns))
+	for p := range x.conns {
+		peer, ok := p.listenAddr()
+		if !ok {
+			continue
+		}
+
+		var flags byte
+		if p.outbound {
+			flags |= pexReachable
+		}
+		if x.isSeed(p) {
+			flags |= pexSeed
+		}
+		peers[peer.String()] = pexPeer{peer: peer, flags: flags}
+	}
+
+	return peers
+}
+
+func (x *PeerExchange) sendAll() {
+	x.mu.Lock()
+	current := x.connected()
+	msgs := make(map[*PeerConn]pexMsg)
+	for p, sent := range x.conns {
+		if p.private || !p.SupportsExtension(utPexExt) {
+			continue
+		}
+
+		if m, ok := pexDiff(p, sent, current); ok {
+			msgs[p] = m
+		}
+	}
+	x.mu.Unlock()
+
+	// Messages are sent without holding the lock, as a slow peer could block everyone else
+	for p, m := range msgs {
+		if err := p.sendPexMsg(m); err != nil {
+			peer := p.GetPeer()
+			logrus.Debugf("couldn't send 'ut_pex' to peer %s: %s", peer.String(), err.Error())
+		}
+	}
+}
+
+/*
+Builds the message with the changes since the last one sent to p, and records them as sent.
+Reports false if there's nothing new to tell
+*/
+func pexDiff(p *PeerConn, sent map[string]pexPeer, current map[string]pexPeer) (pexMsg, bool) {
+	self, _ := p.listenAddr()
+
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+	addedCount := 0
+	for addr, cp := range current {
+		if _, ok := sent[addr]; ok || addr == self.String() || addedCount >= maxPexPeers {
+			continue
+		}
+
+		if ip4 := cp.peer.IP.To4(); ip4 != nil {
+			added = appendCompactPeer(added, ip4, cp.peer.Port)
+			addedF = append(addedF, cp.flags)
+		} else {
+			added6 = appendCompactPeer(added6, cp.peer.IP.To16(), cp.peer.Port)
+			added6F = append(added6F, cp.flags)
+		}
+		sent[addr] = cp
+		addedCount++
+	}
+
+	droppedCount := 0
+	for addr, sp := range sent {
+		if _, ok := current[addr]; ok || droppedCount >= maxPexPeers {
+			continue
+		}
+
+		if ip4 := sp.peer.IP.To4(); ip4 != nil {
+			dropped = appendCompactPeer(dropped, ip4, sp.peer.Port)
+		} else {
+			dropped6 = appendCompactPeer(dropped6, sp.peer.IP.To16(), sp.peer.Port)
+		}
+		delete(sent, addr)
+		droppedCount++
+	}
+
+	if addedCount == 0 && droppedCount == 0 {
+		return pexMsg{}, false
+	}
+
+	return pexMsg{
+		Added:    string(added),
+		AddedF:   string(addedF),
+		Added6:   string(added6),
+		Added6F:  string(added6F),
+		Dropped:  string(dropped),
+		Dropped6: string(dropped6),
+	}, true
+}
+
+func (p *PeerConn) sendPexMsg(m pexMsg) error {
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, m); err != nil {
+		return fmt.Errorf("failed to marshal ut_pex message: %w", err)
+	}
+
+	return p.SendExtensionMsg(utPexExt, buf.Bytes())
+}
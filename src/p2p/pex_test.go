@@ -0,0 +1,29 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPexFlags(t *testing.T) {
+	seed := &PeerConn{peer: Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, outbound: true}
+	leecher := &PeerConn{peer: Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}, outbound: true}
+	inbound := &PeerConn{peer: Peer{IP: net.IPv4(10, 0, 0, 3), Port: 50000}}
+	inbound.extHandshake.Store(&extendedHandshake{Port: 6881})
+
+	x := NewPeerExchange(nil, func(p *PeerConn) bool { return p == seed || p == inbound })
+	for _, p := range []*PeerConn{seed, leecher, inbound} {
+		x.AddPeer(p)
+	}
+
+	peers := x.connected()
+	for addr, flags := range map[string]byte{
+		"10.0.0.1:6881": pexReachable | pexSeed,
+		"10.0.0.2:6881": pexReachable,
+		"10.0.0.3:6881": pexSeed,
+	} {
+		if peers[addr].flags != flags {
+			t.Fatalf("expected flags %#x for %s, got %#x", flags, addr, peers[addr].flags)
+		}
+	}
+}
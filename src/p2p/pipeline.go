@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bounds of the amount of requests kept outstanding with a peer
+const minRequestQueue = 2
+const MaxRequestQueue = 500
+
+// The queue covers this many round trips, leaving margin for the rate to grow
+const requestQueueRoundTrips = 2
+
+// Download rate is measured over windows of this length
+const rateWindow = time.Second
+
+// Round trip samples older than this are discarded, in case the route changed
+const rttSampleLifetime = 30 * time.Second
+
+type requestKey struct {
+	index uint32
+	begin uint32
+}
+
+/*
+requestPipeline sizes the amount of requests kept outstanding with a peer.
+
+To keep the link busy, the peer must always have requests to serve, enough to cover the time it takes for
+a new one to reach it: the download rate times the round trip time. Going much further just piles up
+requests that may get stuck on a slow peer.
+
+Since blocks queued at the peer take longer to arrive, the lowest round trip time measured recently
+is used. Otherwise the queue would keep growing with itself.
+*/
+type requestPipeline struct {
+	mu     sync.Mutex
+	sentAt map[requestKey]time.Time
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	rate        float64 // Bytes per second, smoothed
+	windowStart time.Time
+	windowBytes int
+
+	limit int // Most outstanding requests the peer accepts. 0 if it didn't say
+}
+
+func newRequestPipeline() *requestPipeline {
+	return &requestPipeline{
+		sentAt: make(map[requestKey]time.Time),
+	}
+}
+
+func (r *requestPipeline) requestSent(index, begin uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if len(r.sentAt) == 0 {
+		// The link was idle, so the rate can't be measured over that time
+		r.windowStart = now
+		r.windowBytes = 0
+	}
+	r.sentAt[requestKey{index, begin}] = now
+}
+
+func (r *requestPipeline) requestCancelled(index, begin uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sentAt, requestKey{index, begin})
+}
+
+/*
+The peer discards every request when choking us
+*/
+func (r *requestPipeline) choked() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clear(r.sentAt)
+}
+
+func (r *requestPipeline) blockReceived(index, begin uint32, length int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	key := requestKey{index, begin}
+	if sent, ok := r.sentAt[key]; ok {
+		delete(r.sentAt, key)
+
+		rtt := now.Sub(sent)
+		if r.minRTT == 0 || rtt < r.minRTT || now.Sub(r.minRTTStamp) > rttSampleLifetime {
+			r.minRTT = rtt
+			r.minRTTStamp = now
+		}
+	}
+
+	r.windowBytes += length
+	if elapsed := now.Sub(r.windowStart); elapsed >= rateWindow {
+		sample := float64(r.windowBytes) / elapsed.Seconds()
+		if r.rate == 0 {
+			r.rate = sample
+		} else {
+			r.rate = 0.7*r.rate + 0.3*sample
+		}
+		r.windowStart = now
+		r.windowBytes = 0
+	}
+}
+
+func (r *requestPipeline) setLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limit = limit
+}
+
+func (r *requestPipeline) size(blockLength int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	upper := MaxRequestQueue
+	if r.limit > 0 {
+		upper = min(upper, r.limit)
+	}
+
+	// Nothing measured yet
+	if r.rate == 0 || r.minRTT == 0 {
+		return min(MaxReqBacklog, upper)
+	}
+
+	blocks := r.rate * r.minRTT.Seconds() * requestQueueRoundTrips / float64(blockLength)
+
+	return min(max(int(math.Ceil(blocks)), minRequestQueue), upper)
+}
+
+/*
+How many requests should be kept outstanding with the peer, for blocks of the given length
+*/
+func (p *PeerConn) RequestQueueSize(blockLength int) int {
+	return p.pipeline.size(blockLength)
+}
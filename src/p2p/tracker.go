@@ -1,15 +1,25 @@
 package p2p
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TatuMon/bittorrent-client/src/torrent"
 	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
 )
 
 type trackerResponse struct {
@@ -20,26 +30,193 @@ type trackerResponse struct {
 	TrackerID      string `bencode:"tracker id"`
 	Complete       uint   `bencode:"complete"`   // aka seeders
 	Incomplete     uint   `bencode:"incomplete"` // aka leechers
-	Peers          string `bencode:"peers"`      // string of bytes
+	Peers6         string `bencode:"peers6"`     // Same as the compact 'peers', for IPv6 peers
+	PeerList       []Peer `bencode:"-"`          // From 'peers', which is parsed on its own
 }
 
 func trackerResponseFromBody(body io.ReadCloser) (*trackerResponse, error) {
-	t := trackerResponse{}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tracker response: %w", err)
+	}
 
-	if err := bencode.Unmarshal(body, &t); err != nil {
+	t := trackerResponse{}
+	if err := bencode.Unmarshal(bytes.NewReader(data), &t); err != nil {
 		return nil, fmt.Errorf("failed to parse tracker response: %w", err)
 	}
 
+	t.PeerList, err = peersFromBencode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers list: %w", err)
+	}
+
 	return &t, nil
 }
 
-// Don't know where to get the port yet
+/*
+'peers' is a string of bytes in the compact model, and a list of dictionaries in the original one, which
+some trackers send anyway. The bencode package can't decode a value that may be either into a struct, so
+it's taken from the generic decoding of the response
+*/
+func peersFromBencode(data []byte) ([]Peer, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
+	}
+
+	dict, _ := decoded.(map[string]interface{})
+	switch peers := dict["peers"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return peersFromCompact([]byte(peers))
+	case []interface{}:
+		list := make([]Peer, 0, len(peers))
+		for i, entry := range peers {
+			d, _ := entry.(map[string]interface{})
+			peer, err := peerFromDict(d)
+			if err != nil {
+				logrus.Debugf("ignoring peer #%d sent by the tracker: %s", i, err.Error())
+				continue
+			}
+
+			list = append(list, peer)
+		}
+
+		return list, nil
+	default:
+		return nil, errors.New("'peers' is neither a string nor a list")
+	}
+}
+
+/*
+The 'ip' of peers in the dictionary model may be an IPv4 or IPv6 address, or a domain name. Domain names are
+resolved when connecting to the peer, so slow lookups don't hold up the announce
+*/
+func peerFromDict(d map[string]interface{}) (Peer, error) {
+	ip, _ := d["ip"].(string)
+	port, _ := d["port"].(int64)
+	if ip == "" || port <= 0 || port > 65535 {
+		return Peer{}, errors.New("missing or invalid 'ip' or 'port'")
+	}
+
+	peer := Peer{IP: net.ParseIP(ip), Port: uint16(port)}
+	if peer.IP == nil {
+		if !isValidHostname(ip) {
+			return Peer{}, fmt.Errorf("'%s' is neither an IP address nor a domain name", ip)
+		}
+		peer.Host = ip
+	}
+
+	if id, _ := d["peer id"].(string); len(id) == len(Handshake{}.PeerID) {
+		peer.ID = id
+	}
+
+	return peer, nil
+}
+
+/*
+Domain names are dot-separated labels of letters, digits and hyphens, which can't start or end a label
+*/
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/*
+The port we listen on for peers, or the default one if we aren't listening
+*/
 func getTrackerPort() uint {
-	return 6881
+	if port := listenPort.Load(); port != 0 {
+		return uint(port)
+	}
+
+	return DefaultListenPort
 }
 
-func getTrackerURL(torr *torrent.Torrent) (string, error) {
-	baseURL, err := url.Parse(torr.Announce)
+// Bytes left reported while the size of the torrent isn't known
+const unknownLeft = 16 * 1024
+
+var trackerHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+type AnnounceEvent string
+
+const (
+	EventNone      AnnounceEvent = ""
+	EventStarted   AnnounceEvent = "started"
+	EventCompleted AnnounceEvent = "completed"
+	EventStopped   AnnounceEvent = "stopped"
+)
+
+func (e AnnounceEvent) udpCode() uint32 {
+	switch e {
+	case EventCompleted:
+		return 1
+	case EventStarted:
+		return 2
+	case EventStopped:
+		return 3
+	default:
+		return 0
+	}
+}
+
+/*
+TransferStats are the byte counts reported to the trackers.
+
+Uploaded and Downloaded count every byte of piece data sent and received since the download started.
+Left is how many bytes are missing to have the whole torrent.
+*/
+type TransferStats struct {
+	Uploaded   atomic.Uint64
+	Downloaded atomic.Uint64
+	Left       atomic.Uint64
+}
+
+type announceParams struct {
+	event      AnnounceEvent
+	trackerID  string
+	uploaded   uint64
+	downloaded uint64
+	left       uint64
+}
+
+func newAnnounceParams(event AnnounceEvent, stats *TransferStats) announceParams {
+	return announceParams{
+		event:      event,
+		uploaded:   stats.Uploaded.Load(),
+		downloaded: stats.Downloaded.Load(),
+		left:       stats.Left.Load(),
+	}
+}
+
+/*
+announceResult is what's useful from a tracker response, no matter the protocol used
+*/
+type announceResult struct {
+	peers       []Peer
+	interval    time.Duration
+	minInterval time.Duration // 0 if the tracker didn't set one
+	trackerID   string
+}
+
+func getTrackerURL(torr *torrent.Torrent, announce string, params announceParams) (string, error) {
+	baseURL, err := url.Parse(announce)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate URL: %w", err)
 	}
@@ -48,26 +225,58 @@ func getTrackerURL(torr *torrent.Torrent) (string, error) {
 		"info_hash":  []string{string(torr.InfoHash[:])},
 		"peer_id":    []string{getClientPeerID()},
 		"port":       []string{strconv.Itoa(int(getTrackerPort()))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{strconv.Itoa(int(torr.FileSize))},
+		"uploaded":   []string{strconv.FormatUint(params.uploaded, 10)},
+		"downloaded": []string{strconv.FormatUint(params.downloaded, 10)},
+		"left":       []string{strconv.FormatUint(params.left, 10)},
 		"compact":    []string{"1"},
 	}
 
+	if params.event != EventNone {
+		qParams.Set("event", string(params.event))
+	}
+
+	if params.trackerID != "" {
+		qParams.Set("trackerid", params.trackerID)
+	}
+
 	baseURL.RawQuery = qParams.Encode()
 	return baseURL.String(), nil
 }
 
+/*
+Announces to every tracker of the torrent, tier by tier, until one responds
+*/
 func Announce(torr *torrent.Torrent) ([]Peer, error) {
-	trackerUrl, err := getTrackerURL(torr)
+	return NewTrackers(torr).Announce(torr)
+}
+
+func announceTo(torr *torrent.Torrent, announce string, params announceParams) (*announceResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("malformed announce URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return announceUDP(torr, u.Host, params)
+	case "http", "https":
+		return announceHTTP(torr, announce, params)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol '%s'", u.Scheme)
+	}
+}
+
+func announceHTTP(torr *torrent.Torrent, announce string, params announceParams) (*announceResult, error) {
+	trackerUrl, err := getTrackerURL(torr, announce, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tracker url: %w", err)
 	}
 
-	res, err := http.Get(trackerUrl)
+	res, err := trackerHTTPClient.Get(trackerUrl)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to tracker: %w", err)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode >= 300 {
 		return nil, fmt.Errorf("connection to tracker failed with status %d", res.StatusCode)
@@ -77,7 +286,6 @@ func Announce(torr *torrent.Torrent) ([]Peer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse tracker response: %w", err)
 	}
-	res.Body.Close()
 
 	if len(trackerRes.FailureReason) > 0 {
 		return nil, fmt.Errorf("tracker responded with failure: %s", trackerRes.FailureReason)
@@ -92,5 +300,114 @@ func Announce(torr *torrent.Torrent) ([]Peer, error) {
 		return nil, fmt.Errorf("failed to parse peers list: %w", err)
 	}
 
-	return peers, nil
+	return &announceResult{
+		peers:       peers,
+		interval:    time.Duration(trackerRes.Interval) * time.Second,
+		minInterval: time.Duration(trackerRes.MinInterval) * time.Second,
+		trackerID:   trackerRes.TrackerID,
+	}, nil
+}
+
+/*
+Trackers keeps the tiers of trackers of a torrent, following the multitracker extension (BEP 12).
+
+Each tier is shuffled once. Trackers are tried in order, tier by tier, and the first one that responds
+gets moved to the front of its tier, so it's the first one tried next time.
+
+https://www.bittorrent.org/beps/bep_0012.html
+*/
+type Trackers struct {
+	mu         sync.Mutex
+	tiers      [][]string
+	trackerIDs map[string]string // Tracker ID sent by each tracker, which must be sent back on the next announces
+}
+
+func NewTrackers(torr *torrent.Torrent) *Trackers {
+	tiers := make([][]string, len(torr.AnnounceList))
+	for i, tier := range torr.AnnounceList {
+		tiers[i] = make([]string, len(tier))
+		copy(tiers[i], tier)
+		rand.Shuffle(len(tiers[i]), func(a, b int) {
+			tiers[i][a], tiers[i][b] = tiers[i][b], tiers[i][a]
+		})
+	}
+
+	return &Trackers{
+		tiers:      tiers,
+		trackerIDs: make(map[string]string),
+	}
+}
+
+/*
+Moves the tracker to the front of its tier. Another announce may have reordered the tier in the meantime,
+so it's looked up by name
+*/
+func (t *Trackers) promote(tierIndex int, tracker string) {
+	tier := t.tiers[tierIndex]
+	trackerIndex := slices.Index(tier, tracker)
+	if trackerIndex < 0 {
+		return
+	}
+
+	copy(tier[1:trackerIndex+1], tier[:trackerIndex])
+	tier[0] = tracker
+}
+
+/*
+The lock is only held to read and update the tiers, never while waiting for a tracker, so a slow tracker
+doesn't hold back the other announces
+*/
+func (t *Trackers) announce(torr *torrent.Torrent, params announceParams) (*announceResult, error) {
+	t.mu.Lock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+	t.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	failures := make([]string, 0)
+	for i, tier := range tiers {
+		for _, tracker := range tier {
+			t.mu.Lock()
+			params.trackerID = t.trackerIDs[tracker]
+			t.mu.Unlock()
+
+			res, err := announceTo(torr, tracker, params)
+			if err != nil {
+				logrus.Warnf("failed to announce to tracker %s: %s", tracker, err.Error())
+				failures = append(failures, fmt.Sprintf("%s: %s", tracker, err.Error()))
+				continue
+			}
+
+			t.mu.Lock()
+			if res.trackerID != "" {
+				t.trackerIDs[tracker] = res.trackerID
+			}
+			t.promote(i, tracker)
+			t.mu.Unlock()
+
+			return res, nil
+		}
+	}
+
+	return nil, fmt.Errorf("every tracker failed: %s", strings.Join(failures, "; "))
+}
+
+func (t *Trackers) Announce(torr *torrent.Torrent) ([]Peer, error) {
+	left := uint64(torr.FileSize)
+	if left == 0 {
+		// The size isn't known before fetching a magnet's metadata, and with nothing left we'd look like a seed
+		left = unknownLeft
+	}
+
+	res, err := t.announce(torr, announceParams{left: left})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.peers, nil
 }
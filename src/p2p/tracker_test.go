@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDictionaryModelPeers(t *testing.T) {
+	body := "d8:intervali1800e5:peersl" +
+		"d2:ip8:10.0.0.17:peer id20:-XX0001-0123456789ab4:porti6881ee" +
+		"d2:ip11:2001:db8::14:porti6882ee" +
+		"d2:ip16:tracker.invalid.4:porti6883ee" +
+		"d2:ip8:10.0.0.24:porti0ee" +
+		"d2:ip9:bad host!4:porti6884ee" +
+		"ee"
+
+	res, err := trackerResponseFromBody(io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid ports and hosts are skipped
+	if len(res.PeerList) != 3 {
+		t.Fatalf("expected 3 peers, got %v", res.PeerList)
+	}
+	if p := res.PeerList[0]; p.String() != "10.0.0.1:6881" || p.ID != "-XX0001-0123456789ab" {
+		t.Fatalf("unexpected peer %+v", p)
+	}
+	if p := res.PeerList[1]; p.String() != "[2001:db8::1]:6882" || p.ID != "" {
+		t.Fatalf("unexpected peer %+v", p)
+	}
+	// Domain names are resolved when connecting
+	if p := res.PeerList[2]; p.IP != nil || p.Host != "tracker.invalid." || p.String() != "tracker.invalid.:6883" {
+		t.Fatalf("unexpected peer %+v", p)
+	}
+}
+
+func TestIsValidHostname(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"example.com":           true,
+		"peer-1.example.com.":   true,
+		"localhost":             true,
+		"":                      false,
+		".":                     false,
+		"-peer.example.com":     false,
+		"peer-.example.com":     false,
+		"peer..example.com":     false,
+		"bad host":              false,
+		"peer_1.example.com":    false,
+		strings.Repeat("a", 64): false,
+	} {
+		if isValidHostname(host) != valid {
+			t.Fatalf("expected %q valid to be %t", host, valid)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+)
+
+/*
+UDP tracker protocol (BEP 15).
+
+Before announcing, the client must get a connection ID from the tracker, which can be used for a minute.
+Every request is retransmitted if no response arrives after 15 * 2^n seconds. The BEP lets n go up to 8,
+over two hours for a dead tracker, so we give up much sooner and move on to the next tracker.
+
+https://www.bittorrent.org/beps/bep_0015.html
+*/
+
+const udpProtocolID = 0x41727101980
+
+const (
+	udpActionConnect = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+const udpConnIDLifetime = time.Minute
+
+// Variables so tests can shorten them
+var udpBaseTimeout = 15 * time.Second
+var udpMaxRetries = 2 // 15 + 30 + 60 seconds at most for a dead tracker
+
+var errUDPTimeout = errors.New("udp tracker timed out")
+
+/*
+The connection ID is bound to our address, so the same socket is kept for every request to a tracker
+*/
+type udpTracker struct {
+	mu           sync.Mutex
+	conn         net.Conn
+	connID       uint64
+	connIDExpiry time.Time
+}
+
+var udpTrackers = struct {
+	mu       sync.Mutex
+	trackers map[string]*udpTracker
+}{trackers: make(map[string]*udpTracker)}
+
+func getUDPTracker(host string) (*udpTracker, error) {
+	udpTrackers.mu.Lock()
+	defer udpTrackers.mu.Unlock()
+
+	if t, ok := udpTrackers.trackers[host]; ok {
+		return t, nil
+	}
+
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+
+	t := &udpTracker{conn: conn}
+	udpTrackers.trackers[host] = t
+
+	return t, nil
+}
+
+func newTransactionID() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+/*
+Sends the request and waits for the response with the same transaction ID, up until the timeout.
+Stale responses from previous retransmissions are discarded.
+*/
+func (t *udpTracker) roundTrip(req []byte, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := t.conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to write to tracker: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	t.conn.SetReadDeadline(deadline)
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errUDPTimeout
+			}
+			return nil, fmt.Errorf("failed to read from tracker: %w", err)
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		res := buf[:n]
+		if binary.BigEndian.Uint32(res[0:4]) == udpActionError {
+			return nil, fmt.Errorf("tracker responded with failure: %s", string(res[8:]))
+		}
+
+		return res, nil
+	}
+}
+
+func (t *udpTracker) connect(timeout time.Duration) error {
+	transactionID := newTransactionID()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+
+	res, err := t.roundTrip(req, transactionID, timeout)
+	if err != nil {
+		return err
+	}
+
+	if len(res) < 16 || binary.BigEndian.Uint32(res[0:4]) != udpActionConnect {
+		return errors.New("malformed connect response")
+	}
+
+	t.connID = binary.BigEndian.Uint64(res[8:16])
+	t.connIDExpiry = time.Now().Add(udpConnIDLifetime)
+
+	return nil
+}
+
+func (t *udpTracker) announceRequest(torr *torrent.Torrent, transactionID uint32, params announceParams) []byte {
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], t.connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+	copy(req[16:36], torr.InfoHash[:])
+	copy(req[36:56], []byte(getClientPeerID()))
+	binary.BigEndian.PutUint64(req[56:64], params.downloaded)
+	binary.BigEndian.PutUint64(req[64:72], params.left)
+	binary.BigEndian.PutUint64(req[72:80], params.uploaded)
+	binary.BigEndian.PutUint32(req[80:84], params.event.udpCode())
+	binary.BigEndian.PutUint32(req[84:88], 0)                  // IP address: let the tracker use the sender's
+	binary.BigEndian.PutUint32(req[88:92], newTransactionID()) // key
+	binary.BigEndian.PutUint32(req[92:96], 0xFFFFFFFF)         // num_want: -1 means default
+	binary.BigEndian.PutUint16(req[96:98], uint16(getTrackerPort()))
+
+	return req
+}
+
+func (t *udpTracker) announce(torr *torrent.Torrent, params announceParams) (*announceResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// We are leaving, there's no point in waiting for the tracker
+	maxRetries := udpMaxRetries
+	if params.event == EventStopped {
+		maxRetries = 0
+	}
+
+	for n := 0; n <= maxRetries; n++ {
+		timeout := udpBaseTimeout << n
+
+		if time.Now().After(t.connIDExpiry) {
+			err := t.connect(timeout)
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to tracker: %w", err)
+			}
+		}
+
+		transactionID := newTransactionID()
+		res, err := t.roundTrip(t.announceRequest(torr, transactionID, params), transactionID, timeout)
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(res) < 20 || binary.BigEndian.Uint32(res[0:4]) != udpActionAnnounce {
+			return nil, errors.New("malformed announce response")
+		}
+
+		// Trackers reached over IPv6 answer with IPv6 peers (BEP 15)
+		parsePeers := peersFromCompact
+		if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+			parsePeers = peersFromCompact6
+		}
+
+		peers, err := parsePeers(res[20:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse peers list: %w", err)
+		}
+
+		return &announceResult{
+			peers:    peers,
+			interval: time.Duration(binary.BigEndian.Uint32(res[8:12])) * time.Second,
+		}, nil
+	}
+
+	return nil, errUDPTimeout
+}
+
+func announceUDP(torr *torrent.Torrent, host string, params announceParams) (*announceResult, error) {
+	t, err := getUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.announce(torr, params)
+}
@@ -0,0 +1,226 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+)
+
+/*
+fakeUDPTracker answers connect and announce requests on loopback, with a single peer
+*/
+type fakeUDPTracker struct {
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	drop      int // Requests left to ignore, as if they got lost
+	received  int
+	connects  int
+	announces int
+	connID    uint64
+}
+
+/*
+The first drop requests get no answer
+*/
+func newFakeUDPTracker(t *testing.T, drop int) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeUDPTracker{conn: conn, drop: drop}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return f
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+
+		req := buf[:n]
+		res := f.handle(req)
+		if res != nil {
+			f.conn.WriteToUDP(res, addr)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) handle(req []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.received++
+	if f.drop > 0 {
+		f.drop--
+		return nil
+	}
+
+	action := binary.BigEndian.Uint32(req[8:12])
+	res := binary.BigEndian.AppendUint32(nil, action)
+	res = append(res, req[12:16]...) // Transaction ID
+
+	switch action {
+	case udpActionConnect:
+		if binary.BigEndian.Uint64(req[0:8]) != udpProtocolID {
+			return nil
+		}
+
+		f.connects++
+		f.connID = uint64(f.connects) * 1000
+		return binary.BigEndian.AppendUint64(res, f.connID)
+	case udpActionAnnounce:
+		if len(req) < 98 || binary.BigEndian.Uint64(req[0:8]) != f.connID {
+			res := binary.BigEndian.AppendUint32(nil, udpActionError)
+			res = append(res, req[12:16]...)
+			return append(res, "invalid connection ID"...)
+		}
+
+		f.announces++
+		res = binary.BigEndian.AppendUint32(res, 1800) // Interval
+		res = binary.BigEndian.AppendUint32(res, 0)    // Leechers
+		res = binary.BigEndian.AppendUint32(res, 1)    // Seeders
+		return appendCompactPeer(res, net.IPv4(10, 0, 0, 1).To4(), 6881)
+	}
+
+	return nil
+}
+
+func (f *fakeUDPTracker) counts() (received, connects, announces int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.received, f.connects, f.announces
+}
+
+func shortenUDPTimeouts(t *testing.T) {
+	base := udpBaseTimeout
+	udpBaseTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { udpBaseTimeout = base })
+}
+
+func testTorrent() *torrent.Torrent {
+	torr := &torrent.Torrent{FileSize: 1024}
+	copy(torr.InfoHash[:], "0123456789abcdefghij")
+
+	return torr
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	shortenUDPTimeouts(t)
+	f := newFakeUDPTracker(t, 0)
+
+	tr, err := getUDPTracker(f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		res, err := tr.announce(testTorrent(), announceParams{left: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.peers) != 1 || res.peers[0].String() != "10.0.0.1:6881" {
+			t.Fatalf("unexpected peers %v", res.peers)
+		}
+		if res.interval != 1800*time.Second {
+			t.Fatalf("unexpected interval %s", res.interval)
+		}
+	}
+
+	// The connection ID is reused while it's valid
+	if _, connects, announces := f.counts(); connects != 1 || announces != 2 {
+		t.Fatalf("expected 1 connect and 2 announces, got %d and %d", connects, announces)
+	}
+}
+
+func TestUDPTrackerRetriesLostPackets(t *testing.T) {
+	shortenUDPTimeouts(t)
+	f := newFakeUDPTracker(t, 2) // The first connect and the first announce get lost
+
+	tr, err := getUDPTracker(f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tr.announce(testTorrent(), announceParams{left: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.peers) != 1 {
+		t.Fatalf("unexpected peers %v", res.peers)
+	}
+
+	if received, connects, announces := f.counts(); received != 4 || connects != 1 || announces != 1 {
+		t.Fatalf("expected 4 requests, 1 connect and 1 announce, got %d, %d and %d", received, connects, announces)
+	}
+}
+
+func TestUDPTrackerConnIDExpiry(t *testing.T) {
+	shortenUDPTimeouts(t)
+	f := newFakeUDPTracker(t, 0)
+
+	tr, err := getUDPTracker(f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tr.announce(testTorrent(), announceParams{left: 1024}); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	tr.connIDExpiry = time.Now().Add(-time.Second)
+	tr.mu.Unlock()
+
+	if _, err := tr.announce(testTorrent(), announceParams{left: 1024}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, connects, announces := f.counts(); connects != 2 || announces != 2 {
+		t.Fatalf("expected 2 connects and 2 announces, got %d and %d", connects, announces)
+	}
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	shortenUDPTimeouts(t)
+	f := newFakeUDPTracker(t, 1<<30)
+
+	tr, err := getUDPTracker(f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tr.announce(testTorrent(), announceParams{left: 1024})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	if received, _, _ := f.counts(); received != udpMaxRetries+1 {
+		t.Fatalf("expected %d connect attempts, got %d", udpMaxRetries+1, received)
+	}
+
+	// Nobody waits for the tracker when leaving
+	_, err = tr.announce(testTorrent(), announceParams{event: EventStopped})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if received, _, _ := f.counts(); received != udpMaxRetries+2 {
+		t.Fatalf("expected a single attempt for 'stopped', got %d", received-udpMaxRetries-1)
+	}
+}
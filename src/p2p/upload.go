@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/TatuMon/bittorrent-client/logger"
+)
+
+// Requests for bigger blocks are considered abusive by most clients
+const maxRequestLength = 128 * 1024
+
+/*
+PieceSource gives access to the verified pieces, so they can be served to peers
+*/
+type PieceSource interface {
+	Bitfield() Bitfield // Pieces that can be served
+	ReadBlock(index int, begin int, length int) ([]byte, error)
+	BlockUploaded(length int) // Called after each block sent
+}
+
+/*
+PeerObserver gets told about the pieces peers announce, and about their interest in ours.
+If the PieceSource given to a connection implements it, it gets notified of that peer's messages.
+*/
+type PeerObserver interface {
+	PeerBitfield(p *PeerConn, bitfield Bitfield)
+	PeerHave(p *PeerConn, index int)
+	PeerInterestChanged(p *PeerConn) // Called on every 'interested' and 'not interested'
+}
+
+func (p *PeerConn) SendBitfield(bitfield Bitfield) error {
+	if !bitfield.HasAny() {
+		// Sending it is optional when we have nothing
+		return nil
+	}
+
+	msg := Message{
+		ID:      MsgBitField,
+		Payload: bitfield,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message sent to peer %s", msg.ID.String(), p.peer.String())
+
+	return nil
+}
+
+func (p *PeerConn) SendHave(index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	msg := Message{
+		ID:      MsgHave,
+		Payload: payload,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message for piece %d sent to peer %s", msg.ID.String(), index, p.peer.String())
+
+	return nil
+}
+
+func (p *PeerConn) sendBlock(index uint32, begin uint32, data []byte) error {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], index)
+	binary.BigEndian.PutUint32(payload[4:8], begin)
+	copy(payload[8:], data)
+
+	msg := Message{
+		ID:      MsgPiece,
+		Payload: payload,
+	}
+
+	if err := p.write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	logger.LogSentMessage("'%s' message (piece %d, offset %d) sent to peer %s", msg.ID.String(), index, begin, p.peer.String())
+
+	return nil
+}
+
+/*
+Serves the requested block, as long as it's from a piece we have and we aren't choking the peer.
+Peers with the fast extension get a reject for every request not served
+*/
+func (p *PeerConn) handleRequest(payload []byte) error {
+	if len(payload) != 12 {
+		return errors.New("malformed request")
+	}
+
+	index := binary.BigEndian.Uint32(payload[0:4])
+	begin := binary.BigEndian.Uint32(payload[4:8])
+	length := binary.BigEndian.Uint32(payload[8:12])
+
+	reject := func() error {
+		if !p.supportsFast {
+			return nil
+		}
+
+		return p.sendRejectRequest(payload)
+	}
+
+	if p.source == nil {
+		return reject()
+	}
+
+	if length == 0 || length > maxRequestLength {
+		return fmt.Errorf("invalid request length %d", length)
+	}
+
+	if p.AmChoking() {
+		// Requests sent before the peer got our choke aren't served
+		logger.LogRecvMessage("peer %s requested piece %d while choked", p.peer.String(), index)
+		return reject()
+	}
+
+	if !p.source.Bitfield().HasPiece(int(index)) {
+		logger.LogRecvMessage("peer %s requested piece %d, which we don't have", p.peer.String(), index)
+		return reject()
+	}
+
+	data, err := p.source.ReadBlock(int(index), int(begin), int(length))
+	if err != nil {
+		return fmt.Errorf("failed to read block: %w", err)
+	}
+
+	if err := p.sendBlock(index, begin, data); err != nil {
+		return err
+	}
+	p.uploaded.Add(uint64(len(data)))
+	p.source.BlockUploaded(len(data))
+
+	return nil
+}
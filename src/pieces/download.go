@@ -0,0 +1,243 @@
+package pieces
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TatuMon/bittorrent-client/src/dht"
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/sirupsen/logrus"
+)
+
+const keepAliveInterval = 60 * time.Second
+
+// Peers we only upload to may stay quiet for a while, as long as they send keep alives
+const serveReadTimeout = 3 * time.Minute
+
+type DownloadOptions struct {
+	Seed  bool       // Keep serving the pieces after the download finishes, until interrupted
+	Port  uint16     // Port to accept peers on
+	DHT   *dht.Node  // Node to look for peers in the mainline DHT through. nil to not use the DHT
+	LSD   bool       // Look for peers on the local network too
+	Peers []p2p.Peer // Peers to connect to besides the ones found, like the ones a magnet link lists
+}
+
+/*
+download keeps track of the pieces we have on disk and the peers we are connected to,
+and serves those pieces to them.
+*/
+type download struct {
+	torr       *torrent.Torrent
+	store      *storage
+	stats      *p2p.TransferStats
+	resumePath string
+	picker     *piecePicker
+	choker     *p2p.Choker
+	pex        *p2p.PeerExchange
+
+	mu      sync.RWMutex
+	have    p2p.Bitfield // Pieces verified and written to disk
+	missing int          // Pieces not in have
+	peers   map[*p2p.PeerConn]struct{}
+}
+
+/*
+have holds the pieces already on disk. The peers learnt from connected ones are sent to found
+*/
+func newDownload(torr *torrent.Torrent, store *storage, stats *p2p.TransferStats, have p2p.Bitfield, outPath string, found chan<- []p2p.Peer) *download {
+	missing := 0
+	for i := range torr.TotalPieces {
+		if !have.HasPiece(i) {
+			missing++
+		}
+	}
+
+	d := &download{
+		torr:       torr,
+		store:      store,
+		stats:      stats,
+		resumePath: resumeFilePath(outPath),
+		picker:     newPiecePicker(torr, have),
+		have:       have,
+		missing:    missing,
+		peers:      make(map[*p2p.PeerConn]struct{}),
+	}
+	d.pex = p2p.NewPeerExchange(found, d.picker.hasAll)
+	d.choker = p2p.NewChoker(func() bool { return d.missingPieces() == 0 })
+
+	return d
+}
+
+func (d *download) Bitfield() p2p.Bitfield {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	b := make(p2p.Bitfield, len(d.have))
+	copy(b, d.have)
+
+	return b
+}
+
+func (d *download) ReadBlock(index int, begin int, length int) ([]byte, error) {
+	pieceSize := int(d.torr.CalculatePieceSize(uint(index)))
+	if begin < 0 || begin+length > pieceSize {
+		return nil, fmt.Errorf("block (offset %d, length %d) exceeds piece %d", begin, length, index)
+	}
+
+	buf := make([]byte, length)
+	if _, err := d.store.ReadAt(buf, int64(index)*int64(d.torr.PieceSize)+int64(begin)); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (d *download) BlockUploaded(length int) {
+	d.stats.Uploaded.Add(uint64(length))
+}
+
+func (d *download) addPeer(p *p2p.PeerConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.peers[p] = struct{}{}
+	d.picker.addPeer(p)
+	d.choker.AddPeer(p)
+	d.pex.AddPeer(p)
+}
+
+func (d *download) removePeer(p *p2p.PeerConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.peers, p)
+	d.picker.removePeer(p)
+	d.choker.RemovePeer(p)
+	d.pex.RemovePeer(p)
+}
+
+func (d *download) PeerBitfield(p *p2p.PeerConn, bitfield p2p.Bitfield) {
+	d.picker.peerBitfield(p, bitfield)
+	d.updateInterest(p)
+}
+
+func (d *download) PeerHave(p *p2p.PeerConn, index int) {
+	d.picker.peerHave(p, index)
+	d.updateInterest(p)
+}
+
+func (d *download) PeerInterestChanged(p *p2p.PeerConn) {
+	d.choker.InterestChanged()
+}
+
+func (d *download) PeersExchanged(p *p2p.PeerConn, added []p2p.Peer) {
+	d.pex.Found(added)
+}
+
+/*
+Tells the peer whether it has anything we need
+*/
+func (d *download) updateInterest(p *p2p.PeerConn) {
+	if err := p.UpdateInterest(func() bool { return d.picker.wants(p) }); err != nil {
+		peer := p.GetPeer()
+		logrus.Debugf("couldn't update interest in peer %s: %s", peer.String(), err.Error())
+	}
+}
+
+func (d *download) connectedPeers() []*p2p.PeerConn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	peers := make([]*p2p.PeerConn, 0, len(d.peers))
+	for p := range d.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+/*
+Puts the piece back to be downloaded again, which may make us interested in peers we weren't
+*/
+func (d *download) pieceFailed(piece *PieceProgress) {
+	d.picker.pieceFailed(piece)
+	for _, p := range d.connectedPeers() {
+		d.updateInterest(p)
+	}
+}
+
+/*
+Marks the piece as available to be served, and lets every connected peer know about it.
+Peers left with nothing we need are told we aren't interested anymore
+*/
+func (d *download) pieceDone(index int) {
+	d.mu.Lock()
+	if !d.have.HasPiece(index) {
+		d.have.SetPiece(index)
+		d.missing--
+	}
+	d.mu.Unlock()
+
+	for _, p := range d.connectedPeers() {
+		if err := p.SendHave(index); err != nil {
+			peer := p.GetPeer()
+			logrus.Debugf("couldn't send 'have' to peer %s: %s", peer.String(), err.Error())
+		}
+		// The piece may have been the last one we needed from the peer
+		d.updateInterest(p)
+	}
+}
+
+func (d *download) missingPieces() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.missing
+}
+
+func keepAlive(p *p2p.PeerConn) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.Closed():
+			return
+		case <-ticker.C:
+			if err := p.SendKeepAlive(); err != nil {
+				peer := p.GetPeer()
+				logrus.Warnf("couldn't send 'keep alive' to peer %s: %s. closing connection", peer.String(), err.Error())
+				p.CloseConn()
+				return
+			}
+		}
+	}
+}
+
+/*
+Sends every connection from both channels to the returned one, which is closed once both are
+*/
+func mergePeerConns(a <-chan *p2p.PeerConn, b <-chan *p2p.PeerConn) chan *p2p.PeerConn {
+	channel := make(chan *p2p.PeerConn)
+
+	var wg sync.WaitGroup
+	forward := func(c <-chan *p2p.PeerConn) {
+		defer wg.Done()
+		for p := range c {
+			channel <- p
+		}
+	}
+
+	wg.Add(2)
+	go forward(a)
+	go forward(b)
+
+	go func() {
+		wg.Wait()
+		close(channel)
+	}()
+
+	return channel
+}
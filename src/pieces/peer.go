@@ -0,0 +1,96 @@
+package pieces
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+peerReader reads every message from a peer in the background, so its requests and announcements are
+handled even while we aren't downloading anything from it. The blocks it sends are passed on to the worker
+downloading from it.
+*/
+type peerReader struct {
+	blocks       chan *PieceBlock
+	chokeChanged chan struct{} // Signaled whenever the peer chokes or unchokes us, or changes what we may request
+}
+
+/*
+Blocks arriving once downloadCtx is done are dropped, as no worker is left to take them
+*/
+func startPeerReader(d *download, p *p2p.PeerConn, downloadCtx context.Context) *peerReader {
+	r := &peerReader{
+		// Room for every block we may have requested, so the reader doesn't stall while the worker waits
+		// for something to request, like when cancelled blocks keep arriving in endgame
+		blocks:       make(chan *PieceBlock, p2p.MaxRequestQueue),
+		chokeChanged: make(chan struct{}, 1),
+	}
+
+	go r.run(d, p, downloadCtx)
+
+	return r
+}
+
+/*
+Reads until the connection fails or gets closed, which it then closes. Two seeds have nothing to give
+each other, so the connection is also closed once both we and the peer are complete.
+*/
+func (r *peerReader) run(d *download, p *p2p.PeerConn, downloadCtx context.Context) {
+	defer p.CloseConn()
+	peer := p.GetPeer()
+
+	for {
+		msg, err := p.ReadTimeout(serveReadTimeout)
+		if err != nil {
+			select {
+			case <-p.Closed():
+			default:
+				logrus.Warnf("failed to read from peer %s: %s. closing connection", peer.String(), err.Error())
+			}
+			return
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case p2p.MsgPiece:
+			block, err := PieceBlockFromMessage(msg)
+			if err != nil {
+				logrus.Warnf("peer %s sent an invalid block: %s. closing connection", peer.String(), err.Error())
+				return
+			}
+
+			select {
+			case r.blocks <- block:
+			case <-downloadCtx.Done():
+				logrus.Debugf("dropping block (piece %d, offset %d), the download is over", block.Index, block.Begin)
+			case <-p.Closed():
+				return
+			}
+		case p2p.MsgRejectRequest:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			d.picker.requestRejected(p, index, begin)
+			r.signalChokeChanged()
+		case p2p.MsgChoke, p2p.MsgUnchoke, p2p.MsgAllowedFast:
+			r.signalChokeChanged()
+		case p2p.MsgHave, p2p.MsgBitField, p2p.MsgHaveAll:
+			if d.missingPieces() == 0 && d.picker.hasAll(p) {
+				logrus.Debugf("peer %s is a seed too. closing connection", peer.String())
+				return
+			}
+		}
+	}
+}
+
+func (r *peerReader) signalChokeChanged() {
+	select {
+	case r.chokeChanged <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,444 @@
+package pieces
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+piecePicker decides which blocks each peer downloads next.
+
+It counts how many connected peers have each piece, from their bitfields and 'have' messages, and starts
+the rarest pieces first. Getting them while they are still around keeps the swarm healthy, and avoids
+ending up waiting for the last pieces to appear. The blocks of a piece may be requested from different
+peers, so large pieces don't depend on a single one. Pieces already started are finished before new ones.
+
+Once every block is requested, it enters endgame: idle peers get blocks already requested from others, so
+a single slow peer doesn't hold the download back. The first copy of a block to arrive is kept, and the
+requests to the other peers are cancelled.
+*/
+type piecePicker struct {
+	torr         *torrent.Torrent
+	mu           sync.Mutex
+	availability []int                          // How many connected peers have each piece
+	peers        map[*p2p.PeerConn]p2p.Bitfield // What we counted from each peer
+	pending      map[int]*PieceProgress         // Pieces not started
+	downloading  map[int]*PieceProgress         // Pieces with blocks missing
+	requests     map[*p2p.PeerConn]int          // Blocks we are waiting from each peer
+	changed      chan struct{}                  // Closed, and replaced, whenever a block may have become available
+}
+
+func newPiecePicker(torr *torrent.Torrent, have p2p.Bitfield) *piecePicker {
+	pending := make(map[int]*PieceProgress)
+	for i, hash := range torr.PiecesHashes {
+		if !have.HasPiece(i) {
+			pending[i] = newPieceProgress(i, hash, torr.CalculatePieceSize(uint(i)))
+		}
+	}
+
+	return &piecePicker{
+		torr:         torr,
+		availability: make([]int, torr.TotalPieces),
+		peers:        make(map[*p2p.PeerConn]p2p.Bitfield),
+		pending:      pending,
+		downloading:  make(map[int]*PieceProgress),
+		requests:     make(map[*p2p.PeerConn]int),
+		changed:      make(chan struct{}),
+	}
+}
+
+/*
+Wakes up every worker waiting for a piece. Must be called with the lock held
+*/
+func (pp *piecePicker) notify() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
+
+func (pp *piecePicker) count(bitfield p2p.Bitfield, delta int) {
+	for i := range pp.availability {
+		if bitfield.HasPiece(i) {
+			pp.availability[i] += delta
+		}
+	}
+}
+
+/*
+Starts counting the peer's pieces. Announcements from peers not added are ignored
+*/
+func (pp *piecePicker) addPeer(p *p2p.PeerConn) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bitfield := p2p.NewBitfield(len(pp.availability))
+	if b := p.GetBitfield(); b != nil {
+		copy(bitfield, *b)
+	}
+
+	pp.peers[p] = bitfield
+	pp.count(bitfield, 1)
+}
+
+func (pp *piecePicker) removePeer(p *p2p.PeerConn) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if bitfield, ok := pp.peers[p]; ok {
+		pp.count(bitfield, -1)
+		delete(pp.peers, p)
+	}
+
+	pp.dropRequestsLocked(p)
+	delete(pp.requests, p)
+}
+
+func (pp *piecePicker) peerBitfield(p *p2p.PeerConn, bitfield p2p.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	old, ok := pp.peers[p]
+	if !ok {
+		return
+	}
+
+	pp.count(old, -1)
+	clear(old)
+	copy(old, bitfield)
+	pp.count(old, 1)
+	pp.notify()
+}
+
+func (pp *piecePicker) peerHave(p *p2p.PeerConn, index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bitfield, ok := pp.peers[p]
+	if !ok || index < 0 || index >= len(pp.availability) || bitfield.HasPiece(index) {
+		return
+	}
+
+	bitfield.SetPiece(index)
+	pp.availability[index]++
+	_, pending := pp.pending[index]
+	_, downloading := pp.downloading[index]
+	if pending || downloading {
+		pp.notify()
+	}
+}
+
+/*
+Reports whether the peer has every piece
+*/
+func (pp *piecePicker) hasAll(p *p2p.PeerConn) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bitfield, ok := pp.peers[p]
+	if !ok {
+		return false
+	}
+
+	for i := range pp.availability {
+		if !bitfield.HasPiece(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Reports whether the peer has any piece we still need
+*/
+func (pp *piecePicker) wants(p *p2p.PeerConn) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bitfield, ok := pp.peers[p]
+	if !ok {
+		return false
+	}
+
+	for i := range pp.pending {
+		if bitfield.HasPiece(i) {
+			return true
+		}
+	}
+	for i := range pp.downloading {
+		if bitfield.HasPiece(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns the rarest pending piece the peer has, or nil if it has none. Ties are broken randomly.
+*/
+func (pp *piecePicker) pickRarest(bitfield p2p.Bitfield) *PieceProgress {
+	var picked *PieceProgress
+	ties := 0
+	for i, piece := range pp.pending {
+		if !bitfield.HasPiece(i) {
+			continue
+		}
+
+		switch {
+		case picked == nil || pp.availability[i] < pp.availability[picked.index]:
+			picked = piece
+			ties = 1
+		case pp.availability[i] == pp.availability[picked.index]:
+			ties++
+			if rand.IntN(ties) == 0 {
+				picked = piece
+			}
+		}
+	}
+
+	return picked
+}
+
+func (pp *piecePicker) request(p *p2p.PeerConn, piece *PieceProgress, block int) blockRequest {
+	piece.blocks[block].requestedTo[p] = struct{}{}
+	pp.requests[p]++
+
+	return piece.blockRequest(block)
+}
+
+/*
+Picks the block to request from the peer. Must be called with the lock held
+*/
+func (pp *piecePicker) pick(p *p2p.PeerConn) (blockRequest, bool) {
+	bitfield, ok := pp.peers[p]
+	if !ok {
+		return blockRequest{}, false
+	}
+
+	if !p.IsUnchoked() {
+		// Only the pieces the peer allows us to get fast can be requested while choked
+		allowed := make(p2p.Bitfield, len(bitfield))
+		for _, index := range p.AllowedFast() {
+			if bitfield.HasPiece(index) {
+				allowed.SetPiece(index)
+			}
+		}
+		bitfield = allowed
+	}
+
+	for _, piece := range pp.downloading {
+		if !bitfield.HasPiece(piece.index) {
+			continue
+		}
+
+		for i, block := range piece.blocks {
+			if !block.received && len(block.requestedTo) == 0 {
+				return pp.request(p, piece, i), true
+			}
+		}
+	}
+
+	if piece := pp.pickRarest(bitfield); piece != nil {
+		delete(pp.pending, piece.index)
+		pp.downloading[piece.index] = piece
+		if len(pp.pending) == 0 {
+			logrus.Debug("entering endgame")
+			// Idle peers may help with the blocks left
+			pp.notify()
+		}
+
+		return pp.request(p, piece, 0), true
+	}
+
+	if len(pp.pending) > 0 {
+		return blockRequest{}, false
+	}
+
+	// Endgame. The block requested from the fewest peers is picked
+	var picked *PieceProgress
+	pickedBlock := -1
+	for _, piece := range pp.downloading {
+		if !bitfield.HasPiece(piece.index) {
+			continue
+		}
+
+		for i, block := range piece.blocks {
+			if _, requested := block.requestedTo[p]; block.received || requested {
+				continue
+			}
+
+			if picked == nil || len(block.requestedTo) < len(picked.blocks[pickedBlock].requestedTo) {
+				picked = piece
+				pickedBlock = i
+			}
+		}
+	}
+
+	if picked == nil {
+		return blockRequest{}, false
+	}
+
+	return pp.request(p, picked, pickedBlock), true
+}
+
+/*
+Returns the next block to request from the peer, if there's any
+*/
+func (pp *piecePicker) tryNext(p *p2p.PeerConn) (blockRequest, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.pick(p)
+}
+
+/*
+Returns the next block to request from the peer, waiting until there's one.
+
+false is returned once ctx is done or the connection gets closed.
+*/
+func (pp *piecePicker) next(p *p2p.PeerConn, ctx context.Context) (blockRequest, bool) {
+	for {
+		pp.mu.Lock()
+		req, ok := pp.pick(p)
+		changed := pp.changed
+		pp.mu.Unlock()
+
+		if ok {
+			return req, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return blockRequest{}, false
+		case <-p.Closed():
+			return blockRequest{}, false
+		case <-changed:
+		}
+	}
+}
+
+/*
+Returns how many blocks we are waiting from the peer
+*/
+func (pp *piecePicker) inFlight(p *p2p.PeerConn) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.requests[p]
+}
+
+/*
+Stores the block, if it was requested from the peer and no one sent it before.
+
+The peers it was requested from too are returned, so the requests get cancelled. If it was the last block
+of the piece, the piece is returned to be verified.
+*/
+func (pp *piecePicker) blockReceived(p *p2p.PeerConn, block *PieceBlock) (completed *PieceProgress, cancelTo []*p2p.PeerConn, accepted bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	piece, ok := pp.downloading[int(block.Index)]
+	if !ok || block.Begin%blockSize != 0 || int(block.Begin/blockSize) >= len(piece.blocks) {
+		return nil, nil, false
+	}
+
+	i := int(block.Begin / blockSize)
+	b := &piece.blocks[i]
+	if _, requested := b.requestedTo[p]; !requested || b.received {
+		return nil, nil, false
+	}
+
+	if uint32(len(block.Data)) != piece.blockRequest(i).length {
+		// It has to be requested again
+		delete(b.requestedTo, p)
+		pp.requests[p]--
+		pp.notify()
+		return nil, nil, false
+	}
+
+	copy(piece.buf[block.Begin:], block.Data)
+	b.received = true
+	piece.downloaded += uint(len(block.Data))
+
+	for peer := range b.requestedTo {
+		pp.requests[peer]--
+		if peer != p {
+			cancelTo = append(cancelTo, peer)
+		}
+	}
+	clear(b.requestedTo)
+
+	if piece.downloaded < piece.size {
+		return nil, cancelTo, true
+	}
+
+	delete(pp.downloading, piece.index)
+	return piece, cancelTo, true
+}
+
+/*
+Frees the block the peer refused to send, so it can be requested again
+*/
+func (pp *piecePicker) requestRejected(p *p2p.PeerConn, index uint32, begin uint32) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	piece, ok := pp.downloading[int(index)]
+	if !ok || begin%blockSize != 0 || int(begin/blockSize) >= len(piece.blocks) {
+		return
+	}
+
+	b := &piece.blocks[begin/blockSize]
+	if _, requested := b.requestedTo[p]; !requested {
+		return
+	}
+
+	delete(b.requestedTo, p)
+	pp.requests[p]--
+	pp.notify()
+}
+
+/*
+Must be called when a completed piece doesn't match its hash, so it gets downloaded again
+*/
+func (pp *piecePicker) pieceFailed(piece *PieceProgress) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	piece.reset()
+	pp.pending[piece.index] = piece
+	pp.notify()
+}
+
+func (pp *piecePicker) dropRequestsLocked(p *p2p.PeerConn) {
+	dropped := false
+	for _, piece := range pp.downloading {
+		for i := range piece.blocks {
+			if _, ok := piece.blocks[i].requestedTo[p]; ok {
+				delete(piece.blocks[i].requestedTo, p)
+				dropped = true
+			}
+		}
+	}
+	pp.requests[p] = 0
+
+	if dropped {
+		pp.notify()
+	}
+}
+
+/*
+Forgets every block requested from the peer, so they can be requested from others.
+Must be called when the peer chokes us, as it discards our requests.
+*/
+func (pp *piecePicker) dropRequests(p *p2p.PeerConn) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.dropRequestsLocked(p)
+}
@@ -7,10 +7,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
 	"sync/atomic"
 	"time"
 
+	"github.com/TatuMon/bittorrent-client/src/lsd"
 	"github.com/TatuMon/bittorrent-client/src/p2p"
 	"github.com/TatuMon/bittorrent-client/src/torrent"
 	"github.com/sirupsen/logrus"
@@ -18,7 +18,12 @@ import (
 
 // 16KB maximum for compatibility: https://wiki.theory.org/BitTorrentSpecification#request:_.3Clen.3D0013.3E.3Cid.3D6.3E.3Cindex.3E.3Cbegin.3E.3Clength.3E
 const blockSize = 16 * 1024
-const maxPipelinedRequests = 5
+
+// Peers taking longer than this to send the blocks we requested are dropped
+const blockTimeout = 60 * time.Second
+
+// Sent by writePiecesToFileAsync once every piece is written
+var errDownloadCompleted = errors.New("download completed")
 
 type PieceBlock struct {
 	Index uint32
@@ -31,6 +36,10 @@ func PieceBlockFromMessage(msg *p2p.Message) (*PieceBlock, error) {
 		return nil, fmt.Errorf("wrong message given: must be of type 'piece' but '%s' given", msg.ID.String())
 	}
 
+	if len(msg.Payload) < 8 {
+		return nil, errors.New("malformed 'piece' message")
+	}
+
 	p := PieceBlock{
 		Index: binary.BigEndian.Uint32(msg.Payload[0:4]),
 		Begin: binary.BigEndian.Uint32(msg.Payload[4:8]),
@@ -43,7 +52,8 @@ func PieceBlockFromMessage(msg *p2p.Message) (*PieceBlock, error) {
 /*
 PieceProgress represents the download process of a single piece.
 
-A single PieceProgress MUST be handled by at most ONE worker goroutine
+Its blocks may be requested from several peers at once, so it's only handled with the picker's lock held,
+until every block is received.
 */
 type PieceProgress struct {
 	index        int
@@ -51,28 +61,50 @@ type PieceProgress struct {
 	buf          []byte
 	expectedHash torrent.Sha1Checksum
 	completed    bool
-	requested    uint
 	downloaded   uint
+	blocks       []blockProgress
+}
+
+type blockProgress struct {
+	received    bool
+	requestedTo map[*p2p.PeerConn]struct{} // Peers we are waiting the block from. Several only in endgame
+}
+
+/*
+A block to request, or that was requested
+*/
+type blockRequest struct {
+	index  uint32
+	begin  uint32
+	length uint32
 }
 
 func newPieceProgress(index int, expectedHash torrent.Sha1Checksum, pieceSize uint) *PieceProgress {
+	blocks := make([]blockProgress, (pieceSize+blockSize-1)/blockSize)
+	for i := range blocks {
+		blocks[i].requestedTo = make(map[*p2p.PeerConn]struct{})
+	}
+
 	return &PieceProgress{
 		index:        index,
 		size:         pieceSize,
 		buf:          make([]byte, pieceSize),
 		expectedHash: expectedHash,
 		completed:    false,
+		blocks:       blocks,
 	}
 }
 
-func (p *PieceProgress) calcNextBlockSize() uint {
+func (p *PieceProgress) blockRequest(block int) blockRequest {
+	begin := uint(block) * blockSize
 	// Last block might be smaller than the rest
-	if p.size-p.requested < uint(blockSize) {
-		s := p.size - p.requested
-		return s
-	}
+	length := min(blockSize, p.size-begin)
 
-	return uint(blockSize)
+	return blockRequest{
+		index:  uint32(p.index),
+		begin:  uint32(begin),
+		length: uint32(length),
+	}
 }
 
 func (p *PieceProgress) ValidateHash() error {
@@ -87,147 +119,178 @@ func (p *PieceProgress) ValidateHash() error {
 
 func (p *PieceProgress) reset() {
 	p.downloaded = 0
-	p.requested = 0
+	for i := range p.blocks {
+		p.blocks[i].received = false
+		clear(p.blocks[i].requestedTo)
+	}
 }
 
-func genPiecesProgresses(torr *torrent.Torrent) chan *PieceProgress {
-	channel := make(chan *PieceProgress, len(torr.PiecesHashes))
+/*
+Keeps requesting blocks from the peer and storing the ones it sends, until downloadCtx is done.
+pieceDone is called with every piece completed and verified.
+*/
+func downloadFromPeer(d *download, peer *p2p.PeerConn, reader *peerReader, pieceDone func(*PieceProgress), downloadCtx context.Context) error {
+	timeout := time.NewTimer(blockTimeout)
+	defer timeout.Stop()
+
+	request := func(req blockRequest) error {
+		if err := peer.SendRequestMsg(req.index, req.begin, req.length); err != nil {
+			return fmt.Errorf("failed to request piece %d: %w", req.index, err)
+		}
 
-	for i, hash := range torr.PiecesHashes {
-		pp := newPieceProgress(i, hash, torr.CalculatePieceSize(uint(i)))
-		channel <- pp
+		return nil
 	}
 
-	return channel
-}
+	for {
+		// The timer only counts while we wait for blocks, so it restarts whenever we start waiting
+		idle := d.picker.inFlight(peer) == 0
 
-func attemptPieceDownload(peer *p2p.PeerConn, piece *PieceProgress) error {
-	for piece.downloaded < piece.size {
-		if peer.IsUnchoked() {
-			for peer.ReqBacklog < p2p.MaxReqBacklog && piece.requested < piece.size {
-				blockSize := piece.calcNextBlockSize()
-				err := peer.SendRequestMsg(uint32(piece.index), uint32(piece.requested), uint32(blockSize))
-				if err != nil {
-					return fmt.Errorf("failed to request piece %d: %w", piece.index, err)
-				}
+		// While choked, only the pieces allowed fast can be picked
+		canRequest := peer.IsUnchoked() || len(peer.AllowedFast()) > 0
+		for canRequest && d.picker.inFlight(peer) < peer.RequestQueueSize(blockSize) {
+			req, ok := d.picker.tryNext(peer)
+			if !ok {
+				break
+			}
 
-				peer.ReqBacklog++
-				piece.requested += blockSize
+			if err := request(req); err != nil {
+				return err
 			}
 		}
 
-		msg, err := peer.Read()
-		if err != nil {
-			return fmt.Errorf("failed to read from peer: %w", err)
+		if peer.IsUnchoked() && d.picker.inFlight(peer) == 0 {
+			// Nothing to request until the peer gets new pieces, or a request to another peer fails
+			if req, ok := d.picker.next(peer, downloadCtx); ok {
+				if err := request(req); err != nil {
+					return err
+				}
+			}
 		}
 
-		if msg != nil && msg.ID == p2p.MsgPiece {
-			block, err := PieceBlockFromMessage(msg)
+		if idle && d.picker.inFlight(peer) > 0 {
+			timeout.Reset(blockTimeout)
+		}
 
-			if err != nil {
-				return fmt.Errorf("failed to get block from message: %w", err)
+		select {
+		case <-downloadCtx.Done():
+			return nil
+		case <-peer.Closed():
+			return errors.New("connection closed")
+		case <-reader.chokeChanged:
+			if !peer.IsUnchoked() && !peer.SupportsFast() {
+				// The peer discards our requests when choking us. With the fast extension, it rejects them instead
+				d.picker.dropRequests(peer)
 			}
-
-			if block.Index != uint32(piece.index) {
-				return fmt.Errorf("wrong piece block: expected index %d, got %d", piece.index, block.Index)
+		case <-timeout.C:
+			if d.picker.inFlight(peer) > 0 {
+				return fmt.Errorf("no block received in %s", blockTimeout)
+			}
+			timeout.Reset(blockTimeout)
+		case block := <-reader.blocks:
+			piece, cancelTo, accepted := d.picker.blockReceived(peer, block)
+			if !accepted {
+				logrus.Debugf("dropping block (piece %d, offset %d), not requested or already received", block.Index, block.Begin)
+				continue
 			}
+			timeout.Reset(blockTimeout)
+			d.stats.Downloaded.Add(uint64(len(block.Data)))
 
-			if block.Begin >= uint32(piece.size) {
-				return fmt.Errorf("wrong piece block: offset exceedes piece size. %d >= %d", block.Begin, piece.size)
+			for _, other := range cancelTo {
+				if err := other.SendCancelMsg(block.Index, block.Begin, uint32(len(block.Data))); err != nil {
+					otherPeer := other.GetPeer()
+					logrus.Debugf("couldn't send 'cancel' to peer %s: %s", otherPeer.String(), err.Error())
+				}
 			}
 
-			if uint64(block.Begin)+uint64(len(block.Data)) > uint64(len(piece.buf)) {
-				return errors.New("wrong piece block: block data overflows piece.")
+			if piece == nil {
+				continue
 			}
 
-			copy(piece.buf[block.Begin:], block.Data)
+			if err := piece.ValidateHash(); err != nil {
+				logrus.Warnf("piece %d invalid: %s. retrying", piece.index, err.Error())
+				d.pieceFailed(piece)
+				continue
+			}
 
-			peer.ReqBacklog--
-			piece.downloaded += uint(len(block.Data))
+			pieceDone(piece)
 		}
 	}
-
-	return nil
 }
 
-func startPiecesDownload(torr *torrent.Torrent, peersChan chan *p2p.PeerConn, workCtx context.Context) chan *PieceProgress {
-	piecesChan := genPiecesProgresses(torr)
+/*
+Downloads every piece from the connected peers, serving them ours at the same time.
+
+If seeding, connections are kept after the download finishes, to keep serving them
+*/
+func startPiecesDownload(d *download, peersChan chan *p2p.PeerConn, announcer *p2p.Announcer, opts DownloadOptions, workCtx context.Context) chan *PieceProgress {
+	torr := d.torr
+	stats := d.stats
+	missing := d.missingPieces()
 	donePieces := make(chan *PieceProgress, torr.TotalPieces)
 	donePiecesTotal := atomic.Uint64{}
+	donePiecesTotal.Store(uint64(torr.TotalPieces - missing))
+	activePeers := atomic.Int64{}
 
 	downloadCtx, downloadCtxCancel := context.WithCancel(workCtx)
-	// Channel cleanup
-	go func() {
-		<-downloadCtx.Done()
-		close(piecesChan)
-		close(donePieces)
-		logrus.Debug("all pieces downloaded")
-	}()
+	if missing == 0 {
+		downloadCtxCancel()
+	}
+
+	pieceDone := func(piece *PieceProgress) {
+		donePieces <- piece
+		done := donePiecesTotal.Add(1)
+		stats.Left.Add(^uint64(piece.size - 1))
+
+		percent := float64(done) / float64(torr.TotalPieces) * 100
+		fmt.Printf("(%0.2f%%) Downloaded piece #%d\n", percent, piece.index)
+
+		if done == uint64(torr.TotalPieces) {
+			logrus.Debug("all pieces downloaded")
+			announcer.Completed()
+			downloadCtxCancel()
+		}
+	}
 
 	go func() {
 		for p := range peersChan {
 			peerConn := p
+			announcer.UpdateConnectedPeers(int(activePeers.Add(1)))
 			go func() {
 				peer := peerConn.GetPeer()
+				d.addPeer(peerConn)
+				defer func() {
+					d.removePeer(peerConn)
+					peerConn.CloseConn()
+					announcer.UpdateConnectedPeers(int(activePeers.Add(-1)))
+				}()
+
+				// Unblocks any pending read once we are done
+				stopClosing := context.AfterFunc(workCtx, func() { peerConn.CloseConn() })
+				defer stopClosing()
+
+				go keepAlive(peerConn)
+
+				reader := startPeerReader(d, peerConn, downloadCtx)
+
+				if downloadCtx.Err() == nil {
+					// Later announcements from the peer update our interest as they arrive
+					if err := peerConn.UpdateInterest(func() bool { return d.picker.wants(peerConn) }); err != nil {
+						logrus.Warnf("peer %s couldn't be told our interest: %s", peer.String(), err.Error())
+						return
+					}
 
-				if err := peerConn.SendUnchoke(); err != nil {
-					logrus.Warnf("peer %s couldn't get unchoked: %s", peer.String(), err.Error())
-					return
-				}
-
-				if err := peerConn.SendInterestedMsg(); err != nil {
-					logrus.Warnf("peer %s couldn't send 'interested': %s", peer.String(), err.Error())
-					return
-				}
-
-				keepAliveTicker := time.Tick(60 * time.Second)
-
-				for {
-					select {
-					case pieceProgress := <-piecesChan:
-						if pieceProgress == nil {
-							return
-						}
-
-						bitfield := peerConn.GetBitfield()
-						if bitfield == nil || !bitfield.HasPiece(pieceProgress.index) {
-							piecesChan <- pieceProgress
-							continue
-						}
-
-						if err := attemptPieceDownload(peerConn, pieceProgress); err != nil {
-							logrus.Warnf("peer %s couldn't download piece %d: %s. closing connection", peer.String(), pieceProgress.index, err.Error())
-							peerConn.CloseConn()
-							piecesChan <- pieceProgress
-							return
-						}
-
-						if err := pieceProgress.ValidateHash(); err != nil {
-							logrus.Warnf("piece %d invalid: %s. retrying", pieceProgress.index, err.Error())
-							pieceProgress.reset()
-							piecesChan <- pieceProgress
-							continue
-						}
-
-						donePieces <- pieceProgress
-						donePiecesTotal.Add(1)
-
-						percent := float64(donePiecesTotal.Load()) / float64(torr.TotalPieces) * 100
-						fmt.Printf("(%0.2f%%) Downloaded piece #%d\n", percent, pieceProgress.index)
-
-						if donePiecesTotal.Load() == uint64(torr.TotalPieces) {
-							downloadCtxCancel()
-							return
-						}
-					case <-keepAliveTicker:
-						if err := peerConn.SendKeepAlive(); err != nil {
-							logrus.Warnf("couldn't send 'keep alive' to peer %s: %s. closing connection", err.Error(), peer.String())
-							return
+					if err := downloadFromPeer(d, peerConn, reader, pieceDone, downloadCtx); err != nil {
+						if workCtx.Err() == nil {
+							logrus.Warnf("stopped downloading from peer %s: %s. closing connection", peer.String(), err.Error())
 						}
-					case <-downloadCtx.Done():
-						peerConn.CloseConn()
+						return
 					}
 				}
+
+				// The reader keeps serving the peer until the connection gets closed
+				if opts.Seed && workCtx.Err() == nil && !d.picker.hasAll(peerConn) {
+					<-peerConn.Closed()
+				}
 			}()
 		}
 	}()
@@ -235,57 +298,166 @@ func startPiecesDownload(torr *torrent.Torrent, peersChan chan *p2p.PeerConn, wo
 	return donePieces
 }
 
-func writePiecesToFileAsync(filename string, pieces chan *PieceProgress, workctx context.Context) chan error {
+/*
+Writes the missing pieces as they arrive, making them available to peers. Once all of them are written and
+flushed, errDownloadCompleted is sent. Any other error means the pieces couldn't be stored
+*/
+func writePiecesToFileAsync(d *download, pieces chan *PieceProgress, workctx context.Context) chan error {
 	errchan := make(chan error, 1)
 
-	file, err := os.Create(filename)
-	if err != nil {
-		errchan <- fmt.Errorf("failed to create output file: %w", err)
-		close(errchan)
-		return errchan
-	}
-
 	go func() {
-		for p := range pieces {
+		for range d.missingPieces() {
+			var p *PieceProgress
 			select {
 			case <-workctx.Done():
 				return
-			default:
+			case p = <-pieces:
 			}
 
-			_, err := file.WriteAt(p.buf, int64(p.index*int(p.size)))
+			_, err := d.store.WriteAt(p.buf, int64(p.index)*int64(d.torr.PieceSize))
 			if err != nil {
 				errchan <- fmt.Errorf("failed to write to file: %w", err)
 				return
 			}
+
+			d.pieceDone(p.index)
+
+			if err := d.saveResume(); err != nil {
+				logrus.Warnf("failed to save resume data: %s", err.Error())
+			}
 		}
-		errchan <- fmt.Errorf("download completed")
+		if err := d.store.Sync(); err != nil {
+			errchan <- err
+			return
+		}
+
+		errchan <- errDownloadCompleted
 		close(errchan)
 	}()
 
 	return errchan
 }
 
-func StartDownload(torr *torrent.Torrent, outFile string) error {
-	peers, err := p2p.Announce(torr)
+/*
+For multi-file torrents, outPath is the directory where the files are placed.
+
+The download stops when ctx is done. Otherwise, it ends once every piece is written, unless seeding.
+*/
+func StartDownload(torr *torrent.Torrent, outPath string, opts DownloadOptions, ctx context.Context) (err error) {
+	store, err := openStorage(torr, outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output files: %w", err)
+	}
+	defer func() {
+		if closeErr := store.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close output files: %w", closeErr)
+		}
+	}()
+
+	workCtx, workCtxCancel := context.WithCancelCause(ctx)
+	defer workCtxCancel(nil)
+
+	have, err := loadPieces(torr, store, outPath)
 	if err != nil {
-		return fmt.Errorf("failed to announce to tracker: %w\n", err)
+		return fmt.Errorf("failed to verify existing data: %w", err)
 	}
 
-	workCtx, workCtxCancel := context.WithCancelCause(context.Background())
+	stats := &p2p.TransferStats{}
+	stats.Left.Store(uint64(torr.FileSize))
+	for i := range torr.TotalPieces {
+		if have.HasPiece(i) {
+			stats.Left.Add(^uint64(torr.CalculatePieceSize(uint(i)) - 1))
+		}
+	}
 
-	peersConns := p2p.ConnectPeersAsync(torr, peers, workCtx)
-	donePieces := startPiecesDownload(torr, peersConns, workCtx)
-	writeErrChan := writePiecesToFileAsync(outFile, donePieces, workCtx)
+	// Fed by the trackers, the DHT, the local network and by the peers themselves, through PEX
+	peers := make(chan []p2p.Peer)
+
+	d := newDownload(torr, store, stats, have, outPath, peers)
+	if missing := d.missingPieces(); missing < torr.TotalPieces {
+		fmt.Printf("resuming download: %d of %d pieces already downloaded\n", torr.TotalPieces-missing, torr.TotalPieces)
+	}
+
+	// Must listen before announcing, so trackers get the right port
+	var inboundConns <-chan *p2p.PeerConn
+	var listenPort uint16
+	listener, err := p2p.Listen(opts.Port)
+	if err != nil {
+		logrus.Warnf("failed to accept incoming peers: %s", err.Error())
+	} else {
+		defer listener.Close()
+		inboundConns = listener.Register(torr, d)
+		listenPort = listener.Port()
+	}
+
+	// Peers of private torrents must only come from their trackers (BEP 27)
+	if opts.DHT != nil && !torr.Private {
+		// If we aren't listening, the DHT is only asked for peers
+		go opts.DHT.AnnounceLoop(workCtx, torr.InfoHash, listenPort, peers)
+	}
+
+	if opts.LSD && !torr.Private {
+		service, err := lsd.New(lsd.Config{Port: listenPort})
+		if err != nil {
+			logrus.Warnf("failed to look for peers on the local network: %s", err.Error())
+		} else {
+			defer service.Close()
+			go service.AnnounceLoop(workCtx, torr.InfoHash, peers)
+		}
+	}
+
+	go d.choker.Run(workCtx)
+	if !torr.Private {
+		go d.pex.Run(workCtx)
+	}
+
+	announcer := p2p.NewAnnouncer(torr, peers, stats)
+	announcerDone := make(chan struct{})
+
+	go func() {
+		announcer.Run(workCtx)
+		close(announcerDone)
+	}()
+
+	peersConns := p2p.ConnectPeersAsync(torr, peers, d, workCtx)
+	if len(opts.Peers) > 0 {
+		go func() {
+			select {
+			case <-workCtx.Done():
+			case peers <- opts.Peers:
+			}
+		}()
+	}
+	if inboundConns != nil {
+		peersConns = mergePeerConns(peersConns, inboundConns)
+		go func() {
+			<-workCtx.Done()
+			listener.Unregister(torr)
+		}()
+	}
+
+	donePieces := startPiecesDownload(d, peersConns, announcer, opts, workCtx)
+	writeErrChan := writePiecesToFileAsync(d, donePieces, workCtx)
 
 	select {
 	case <-workCtx.Done():
-		fmt.Printf("download ended. cause: %s", context.Cause(workCtx).Error())
-		workCtxCancel(nil) // line to satisfy `go vet`
+		fmt.Printf("download ended. cause: %s\n", context.Cause(workCtx).Error())
 	case writeErr := <-writeErrChan:
-		workCtxCancel(writeErr)
+		if !errors.Is(writeErr, errDownloadCompleted) {
+			workCtxCancel(writeErr)
+			<-announcerDone
+			return fmt.Errorf("failed to store pieces: %w", writeErr)
+		}
+
 		fmt.Println(writeErr.Error())
+		if opts.Seed && d.missingPieces() == 0 {
+			fmt.Println("seeding. interrupt to stop")
+			<-workCtx.Done()
+		}
+		workCtxCancel(writeErr)
 	}
 
+	<-announcerDone
+
 	return nil
 }
@@ -0,0 +1,169 @@
+package pieces
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+
+	"github.com/TatuMon/bittorrent-client/src/p2p"
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Fast resume.
+
+A small file kept next to the output remembers which pieces are already written, so they don't have to be
+hashed again on restart. It's only trusted while the files keep the size and modification time they had
+when it was saved. Otherwise, every piece is checked.
+*/
+
+type resumeFile struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"` // Unix nanoseconds
+}
+
+type resumeData struct {
+	InfoHash string       `bencode:"info hash"`
+	Pieces   string       `bencode:"pieces"` // Bitfield of the pieces written
+	Files    []resumeFile `bencode:"files"`
+}
+
+func resumeFilePath(outPath string) string {
+	return outPath + ".resume"
+}
+
+/*
+Hashes every piece already on disk, returning the ones that match the torrent's hashes
+*/
+func verifyPieces(torr *torrent.Torrent, store *storage) (p2p.Bitfield, error) {
+	have := p2p.NewBitfield(torr.TotalPieces)
+	if !store.hasData {
+		return have, nil
+	}
+
+	buf := make([]byte, torr.PieceSize)
+	for i, hash := range torr.PiecesHashes {
+		piece := buf[:torr.CalculatePieceSize(uint(i))]
+		if _, err := store.ReadAt(piece, int64(i)*int64(torr.PieceSize)); err != nil {
+			return nil, fmt.Errorf("failed to read piece %d: %w", i, err)
+		}
+
+		if sha1.Sum(piece) == hash {
+			have.SetPiece(i)
+		}
+	}
+
+	return have, nil
+}
+
+func (s *storage) resumeFiles() ([]resumeFile, error) {
+	files := make([]resumeFile, 0, len(s.files))
+	for _, f := range s.files {
+		info, err := f.file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %w", f.path, err)
+		}
+
+		files = append(files, resumeFile{
+			Size:  info.Size(),
+			MTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	return files, nil
+}
+
+/*
+Returns the pieces saved in the resume file, if it can still be trusted
+*/
+func loadResume(torr *torrent.Torrent, store *storage, path string) (p2p.Bitfield, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := resumeData{}
+	if err := bencode.Unmarshal(f, &data); err != nil {
+		return nil, fmt.Errorf("malformed resume file: %w", err)
+	}
+
+	if data.InfoHash != string(torr.InfoHash[:]) {
+		return nil, fmt.Errorf("resume file is for another torrent")
+	}
+
+	have := p2p.Bitfield(data.Pieces)
+	if expected := p2p.NewBitfield(torr.TotalPieces); len(have) != len(expected) {
+		return nil, fmt.Errorf("resume file has a bitfield of %d bytes, expected %d", len(have), len(expected))
+	}
+
+	files, err := store.resumeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) != len(data.Files) {
+		return nil, fmt.Errorf("resume file has %d files, expected %d", len(data.Files), len(files))
+	}
+
+	for i, f := range files {
+		if f != data.Files[i] {
+			return nil, fmt.Errorf("%s changed since the resume file was saved", store.files[i].path)
+		}
+	}
+
+	return have, nil
+}
+
+/*
+Gets the pieces already on disk, from the resume file if possible
+*/
+func loadPieces(torr *torrent.Torrent, store *storage, outPath string) (p2p.Bitfield, error) {
+	have, err := loadResume(torr, store, resumeFilePath(outPath))
+	if err == nil {
+		return have, nil
+	}
+
+	if !os.IsNotExist(err) {
+		logrus.Warnf("ignoring resume file: %s. checking every piece", err.Error())
+	}
+
+	return verifyPieces(torr, store)
+}
+
+/*
+Saves the pieces we have along with the files' current state. The file gets replaced atomically,
+so a crash never leaves it half written
+*/
+func (d *download) saveResume() error {
+	files, err := d.store.resumeFiles()
+	if err != nil {
+		return err
+	}
+
+	have := d.Bitfield()
+	data := resumeData{
+		InfoHash: string(d.torr.InfoHash[:]),
+		Pieces:   string(have),
+		Files:    files,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := bencode.Marshal(buf, data); err != nil {
+		return fmt.Errorf("failed to marshal resume data: %w", err)
+	}
+
+	tmpPath := d.resumePath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write resume file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, d.resumePath); err != nil {
+		return fmt.Errorf("failed to replace resume file: %w", err)
+	}
+
+	return nil
+}
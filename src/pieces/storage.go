@@ -0,0 +1,170 @@
+package pieces
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/TatuMon/bittorrent-client/src/torrent"
+)
+
+type storageFile struct {
+	path   string
+	offset int64
+	length int64
+	file   *os.File
+}
+
+/*
+storage maps the torrent's data onto the files it's made of.
+
+Pieces don't care about file boundaries, so a single read or write may be split across several files.
+*/
+type storage struct {
+	files   []storageFile
+	hasData bool // Whether any of the files existed with data in it
+}
+
+/*
+In single-file torrents, outPath is the file itself. In multi-file torrents, it's the directory
+where the files get placed.
+*/
+func openStorage(torr *torrent.Torrent, outPath string) (*storage, error) {
+	s := &storage{
+		files: make([]storageFile, 0, len(torr.Files)),
+	}
+
+	for _, f := range torr.Files {
+		path := outPath
+		if torr.MultiFile {
+			path = filepath.Join(outPath, f.Path)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+
+		// Existing data is kept, so interrupted downloads can be resumed
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			s.Close()
+			return nil, fmt.Errorf("failed to stat file %s: %w", path, err)
+		}
+
+		if info.Size() > 0 {
+			s.hasData = true
+		}
+
+		// Reads of pieces not downloaded yet must not hit EOF
+		if info.Size() != int64(f.Length) {
+			if err := file.Truncate(int64(f.Length)); err != nil {
+				file.Close()
+				s.Close()
+				return nil, fmt.Errorf("failed to resize file %s: %w", path, err)
+			}
+		}
+
+		s.files = append(s.files, storageFile{
+			path:   path,
+			offset: int64(f.Offset),
+			length: int64(f.Length),
+			file:   file,
+		})
+	}
+
+	return s, nil
+}
+
+func (s *storage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+
+	for _, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+
+		fileEnd := f.offset + f.length
+		if off >= fileEnd || f.length == 0 {
+			continue
+		}
+
+		chunk := min(int64(len(p)), fileEnd-off)
+		n, err := f.file.WriteAt(p[:chunk], off-f.offset)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("failed to write to %s: %w", f.path, err)
+		}
+
+		p = p[chunk:]
+		off += chunk
+	}
+
+	if len(p) > 0 {
+		return written, fmt.Errorf("write exceeds the torrent's size by %d bytes", len(p))
+	}
+
+	return written, nil
+}
+
+func (s *storage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+
+	for _, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+
+		fileEnd := f.offset + f.length
+		if off >= fileEnd || f.length == 0 {
+			continue
+		}
+
+		chunk := min(int64(len(p)), fileEnd-off)
+		n, err := f.file.ReadAt(p[:chunk], off-f.offset)
+		read += n
+		if err != nil {
+			return read, fmt.Errorf("failed to read from %s: %w", f.path, err)
+		}
+
+		p = p[chunk:]
+		off += chunk
+	}
+
+	if len(p) > 0 {
+		return read, fmt.Errorf("read exceeds the torrent's size by %d bytes", len(p))
+	}
+
+	return read, nil
+}
+
+/*
+Flushes the written data to disk, so a full disk or failing drive surfaces as an error here
+*/
+func (s *storage) Sync() error {
+	for _, f := range s.files {
+		if err := f.file.Sync(); err != nil {
+			return fmt.Errorf("failed to flush %s: %w", f.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *storage) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if err := f.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
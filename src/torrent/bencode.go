@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+/*
+bencode-go only gives us the decoded values, but some things (like the info hash) must be
+calculated over the exact bytes that were received. These helpers walk the raw data without decoding it.
+*/
+
+// Deepest nesting of lists and dictionaries accepted, so malicious data can't exhaust the stack
+const maxBencodeDepth = 64
+
+/*
+Returns the position right after the bencoded value that starts at pos
+*/
+func skipBencodeValue(data []byte, pos int) (int, error) {
+	return skipNestedBencodeValue(data, pos, 0)
+}
+
+func skipNestedBencodeValue(data []byte, pos int, depth int) (int, error) {
+	if pos >= len(data) {
+		return 0, errors.New("unexpected end of data")
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end == -1 {
+			return 0, errors.New("unterminated integer")
+		}
+		if !isCanonicalInt(data[pos+1:pos+end], true) {
+			return 0, fmt.Errorf("malformed integer at %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		if depth >= maxBencodeDepth {
+			return 0, fmt.Errorf("values nested too deep at %d", pos)
+		}
+
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := skipNestedBencodeValue(data, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, errors.New("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := readBencodeString(data, pos)
+		return end, err
+	default:
+		return 0, fmt.Errorf("unexpected character %q at %d", c, pos)
+	}
+}
+
+/*
+Integers have a single encoding: no leading zeros, and no '-0'. String lengths can't be negative either
+*/
+func isCanonicalInt(b []byte, signed bool) bool {
+	if signed && len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+		if len(b) > 0 && b[0] == '0' {
+			return false
+		}
+	}
+
+	if len(b) == 0 || (b[0] == '0' && len(b) > 1) {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Returns the content of the bencoded string that starts at pos and the position right after it
+*/
+func readBencodeString(data []byte, pos int) ([]byte, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon == -1 {
+		return nil, 0, errors.New("malformed string length")
+	}
+
+	length := data[pos : pos+colon]
+	strLen, err := strconv.Atoi(string(length))
+	if err != nil || !isCanonicalInt(length, false) {
+		return nil, 0, fmt.Errorf("malformed string length at %d", pos)
+	}
+
+	// Checked before adding, as a huge length would overflow
+	start := pos + colon + 1
+	if strLen > len(data)-start {
+		return nil, 0, errors.New("string exceeds data length")
+	}
+
+	end := start + strLen
+	return data[start:end], end, nil
+}
+
+/*
+Returns the raw bytes of the value associated to key, inside the dictionary that makes up data.
+*/
+func rawDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("data is not a dictionary")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		k, valStart, err := readBencodeString(data, pos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dictionary key: %w", err)
+		}
+
+		valEnd, err := skipBencodeValue(data, valStart)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value of key %q: %w", k, err)
+		}
+
+		if string(k) == key {
+			return data[valStart:valEnd], nil
+		}
+
+		pos = valEnd
+	}
+
+	return nil, fmt.Errorf("key %q not found", key)
+}
+
+/*
+Splits data into the bencoded value it starts with and whatever comes after it.
+
+Useful for messages where a bencoded dictionary is followed by raw data, like ut_metadata's.
+*/
+func SplitBencodeValue(data []byte) (value []byte, rest []byte, err error) {
+	end, err := skipBencodeValue(data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data[:end], data[end:], nil
+}
@@ -0,0 +1,35 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSkipBencodeValue(t *testing.T) {
+	for _, data := range []string{
+		"i0e", "i-3e", "i42e", "0:", "4:spam", "le", "de",
+		"l4:spami42ee", "d3:bar4:spam3:fooi42ee",
+		strings.Repeat("l", maxBencodeDepth) + strings.Repeat("e", maxBencodeDepth),
+	} {
+		end, err := skipBencodeValue([]byte(data+"rest"), 0)
+		if err != nil {
+			t.Fatalf("failed to skip %q: %s", data, err.Error())
+		}
+		if end != len(data) {
+			t.Fatalf("expected %q to end at %d, got %d", data, len(data), end)
+		}
+	}
+}
+
+func TestSkipMalformedBencodeValue(t *testing.T) {
+	for _, data := range []string{
+		"", "ie", "i-e", "i-0e", "i03e", "i1.5e", "i+1e", "i42",
+		"03:abc", "-1:a", "+1:a", "5:abc", "4spam", "9223372036854775807:abc", "l9223372036854775807:abce",
+		"l4:spam", "d3:foo", "x",
+		strings.Repeat("l", maxBencodeDepth+1) + strings.Repeat("e", maxBencodeDepth+1),
+	} {
+		if _, err := skipBencodeValue([]byte(data), 0); err == nil {
+			t.Fatalf("expected %q to be rejected", data)
+		}
+	}
+}
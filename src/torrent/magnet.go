@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const btihPrefix = "urn:btih:"
+
+/*
+Magnet holds the information found in a magnet URI. Only the info hash is mandatory.
+
+https://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+*/
+type Magnet struct {
+	InfoHash    Sha1Checksum
+	DisplayName string
+	Trackers    []string
+	Peers       []string // host:port pairs
+}
+
+func IsMagnetURI(s string) bool {
+	return strings.HasPrefix(s, "magnet:?")
+}
+
+/*
+The info hash may be encoded either as 40 hex characters or as 32 base32 characters
+*/
+func infoHashFromBtih(btih string) (Sha1Checksum, error) {
+	var checksum Sha1Checksum
+	var decoded []byte
+	var err error
+
+	switch len(btih) {
+	case 40:
+		decoded, err = hex.DecodeString(btih)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(btih))
+	default:
+		return checksum, fmt.Errorf("unexpected info hash length %d", len(btih))
+	}
+
+	if err != nil {
+		return checksum, fmt.Errorf("failed to decode info hash: %w", err)
+	}
+
+	copy(checksum[:], decoded)
+	return checksum, nil
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI: %w", err)
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("unexpected scheme '%s'", u.Scheme)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	m := Magnet{
+		DisplayName: q.Get("dn"),
+		Trackers:    q["tr"],
+		Peers:       q["x.pe"],
+	}
+
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+
+		m.InfoHash, err = infoHashFromBtih(strings.TrimPrefix(xt, btihPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("malformed 'xt' parameter: %w", err)
+		}
+		found = true
+		break
+	}
+
+	if !found {
+		return nil, errors.New("magnet doesn't contain a BitTorrent info hash")
+	}
+
+	return &m, nil
+}
+
+/*
+Returns a torrent with only the information known before fetching the metadata.
+
+It's enough to announce to the trackers and to handshake with peers, but there's nothing to download yet.
+*/
+func (m *Magnet) PartialTorrent() *Torrent {
+	t := m.bencodeTorrent()
+
+	return &Torrent{
+		Announce:     t.Announce,
+		AnnounceList: announceListFromBencode(t),
+		FileName:     m.DisplayName,
+		InfoHash:     m.InfoHash,
+	}
+}
+
+/*
+Magnets don't define tiers, so each tracker is placed in its own one, keeping their order
+*/
+func (m *Magnet) bencodeTorrent() bencodeTorrent {
+	t := bencodeTorrent{
+		AnnounceList: make([][]string, len(m.Trackers)),
+	}
+
+	for i, tracker := range m.Trackers {
+		t.AnnounceList[i] = []string{tracker}
+	}
+
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+
+	return t
+}
+
+/*
+Builds the torrent from the 'info' dictionary fetched from peers.
+
+The metadata is only trusted if its hash matches the one in the magnet.
+*/
+func TorrentFromMetadata(m *Magnet, rawInfo []byte) (*Torrent, error) {
+	if genInfoHash(rawInfo) != m.InfoHash {
+		return nil, errors.New("metadata doesn't match the info hash")
+	}
+
+	info := bencodeTorrentInfo{}
+	if err := bencode.Unmarshal(bytes.NewReader(rawInfo), &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+
+	t := m.bencodeTorrent()
+	t.Info = info
+
+	torr, err := torrentFromBencode(t, rawInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent information: %w", err)
+	}
+
+	return torr, nil
+}
@@ -4,40 +4,69 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
 
 	bencode "github.com/jackpal/bencode-go"
 )
 
 type Sha1Checksum [20]byte
 
+type bencodeTorrentFile struct {
+	Length uint     `bencode:"length"`
+	Path   []string `bencode:"path"` // One element per directory, the last one being the file name
+}
+
 type bencodeTorrentInfo struct {
-	Length      uint   `bencode:"length"` // Length of the final file in bytes
-	Name        string `bencode:"name"`
-	PieceLength uint   `bencode:"piece length"` // Number of bytes in each piece
-	Pieces      string `bencode:"pieces"`       // String consisting of the concatenation of all 20-byte SHA1 hash values, one per piece (byte string, i.e. not urlencoded)
+	Length      uint                 `bencode:"length"`       // Length of the final file in bytes. Only present in single-file torrents
+	Files       []bencodeTorrentFile `bencode:"files"`        // Only present in multi-file torrents
+	Name        string               `bencode:"name"`         // File name in single-file torrents, directory name in multi-file ones
+	PieceLength int                  `bencode:"piece length"` // Number of bytes in each piece
+	Pieces      string               `bencode:"pieces"`       // String consisting of the concatenation of all 20-byte SHA1 hash values, one per piece (byte string, i.e. not urlencoded)
+	Private     int                  `bencode:"private"`      // 1 if peers must only come from the trackers (BEP 27)
 }
 
 type bencodeTorrent struct {
 	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"` // Tiers of trackers: https://www.bittorrent.org/beps/bep_0012.html
 	Info         bencodeTorrentInfo `bencode:"info"`
 	Comment      string             `bencode:"comment"`
 	CreationDate int                `bencode:"creation date"`
 	CreatedBy    string             `bencode:"created by"`
 }
 
+/*
+File is one of the files the torrent is made of.
+
+The content of every file is concatenated, in order, to form the data that gets split into pieces.
+Offset is where the file starts inside that data.
+*/
+type File struct {
+	Path   string // Relative to the torrent's directory. In single-file torrents it's just the file name
+	Length uint
+	Offset uint
+}
+
 type Torrent struct {
 	Announce     string
+	AnnounceList [][]string // Tiers of trackers, in order of preference. Always contains at least the 'announce' tracker, if any
 	Comment      string
 	CreationDate int
 	CreatedBy    string
-	FileSize     uint
+	FileSize     uint // Sum of the length of every file
 	FileName     string
+	MultiFile    bool
+	Files        []File
 	PieceSize    uint
 	PiecesHashes []Sha1Checksum
 	InfoHash     Sha1Checksum
 	TotalPieces  int
+	Nodes        []string // DHT nodes to join the DHT through, as "host:port". Usually only in trackerless torrents
+	Private      bool     // Peers must only come from the trackers: no DHT, local discovery or PEX (BEP 27)
 }
 
 func (t *Torrent) CalculatePieceSize(index uint) uint {
@@ -75,17 +104,121 @@ func TorrentFromFile(torrentPath string) (*Torrent, error) {
 	return torr, nil
 }
 
-func genInfoHash(t bencodeTorrentInfo) (Sha1Checksum, error) {
-	buf := new(bytes.Buffer)
-	if err := bencode.Marshal(buf, t); err != nil {
-		return Sha1Checksum{}, fmt.Errorf("failed to marshal field 'info': %w", err)
+/*
+The info hash MUST be calculated over the exact bytes of the 'info' dictionary, as found in the torrent file.
+Re-encoding the parsed struct would drop every key it doesn't model (like 'private'), changing the hash.
+*/
+func genInfoHash(rawInfo []byte) Sha1Checksum {
+	return sha1.Sum(rawInfo)
+}
+
+/*
+Each path element must be a plain name, so the files can't escape the torrent's directory
+*/
+func isValidPathElement(p string) bool {
+	return p != "" && p != "." && p != ".." && p == filepath.Base(p)
+}
+
+func filePathFromBencode(path []string) (string, error) {
+	if len(path) == 0 {
+		return "", errors.New("empty file path")
+	}
+
+	for _, p := range path {
+		if !isValidPathElement(p) {
+			return "", fmt.Errorf("invalid path element %q", p)
+		}
+	}
+
+	return filepath.Join(path...), nil
+}
+
+func filesFromBencode(info bencodeTorrentInfo) ([]File, uint, error) {
+	if len(info.Files) == 0 {
+		return []File{{Path: info.Name, Length: info.Length}}, info.Length, nil
+	}
+
+	files := make([]File, len(info.Files))
+	var offset uint
+	for i, f := range info.Files {
+		path, err := filePathFromBencode(f.Path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("malformed file #%d: %w", i, err)
+		}
+
+		files[i] = File{
+			Path:   path,
+			Length: f.Length,
+			Offset: offset,
+		}
+		offset += f.Length
+	}
+
+	return files, offset, nil
+}
+
+/*
+If the torrent has no 'announce-list', 'announce' is used as the only tier
+*/
+func announceListFromBencode(t bencodeTorrent) [][]string {
+	tiers := make([][]string, 0, len(t.AnnounceList))
+	for _, tier := range t.AnnounceList {
+		trackers := make([]string, 0, len(tier))
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+
+		if len(trackers) > 0 {
+			tiers = append(tiers, trackers)
+		}
+	}
+
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = append(tiers, []string{t.Announce})
+	}
+
+	return tiers
+}
+
+/*
+'nodes' lists DHT nodes as [host, port] pairs. The bencode package can't decode lists mixing strings and
+integers into a struct, so the raw value is decoded on its own. Malformed nodes are skipped, as they are only
+a hint of where to join the DHT
+*/
+func nodesFromBencode(data []byte) []string {
+	raw, err := rawDictValue(data, "nodes")
+	if err != nil {
+		return nil
+	}
+
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
 	}
 
-	checksum := sha1.Sum(buf.Bytes())
-	return checksum, nil
+	list, _ := decoded.([]interface{})
+	nodes := make([]string, 0, len(list))
+	for _, entry := range list {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+
+		host, hostOk := pair[0].(string)
+		port, portOk := pair[1].(int64)
+		if !hostOk || !portOk || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+
+		nodes = append(nodes, net.JoinHostPort(host, fmt.Sprint(port)))
+	}
+
+	return nodes
 }
 
-func torrentFromBencode(t bencodeTorrent) (*Torrent, error) {
+func torrentFromBencode(t bencodeTorrent, rawInfo []byte) (*Torrent, error) {
 	concatedHashes := []byte(t.Info.Pieces)
 	chunks := len(concatedHashes) / 20
 
@@ -98,38 +231,74 @@ func torrentFromBencode(t bencodeTorrent) (*Torrent, error) {
 		copy(pHashes[i][:], concatedHashes[i*20:(i+1)*20])
 	}
 
-	infoHash, err := genInfoHash(t.Info)
+	infoHash := genInfoHash(rawInfo)
+
+	if !isValidPathElement(t.Info.Name) {
+		return nil, fmt.Errorf("invalid name %q", t.Info.Name)
+	}
+
+	files, totalSize, err := filesFromBencode(t.Info)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate sha1 checksum of field 'info': %w", err)
+		return nil, fmt.Errorf("failed to get files list: %w", err)
+	}
+
+	if t.Info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", t.Info.PieceLength)
+	}
+
+	// One hash per piece, the last one possibly shorter
+	pieceLength := uint(t.Info.PieceLength)
+	expectedPieces := totalSize / pieceLength
+	if totalSize%pieceLength != 0 {
+		expectedPieces++
+	}
+	if uint(len(pHashes)) != expectedPieces {
+		return nil, fmt.Errorf("%d piece hashes for %d pieces", len(pHashes), expectedPieces)
 	}
 
 	return &Torrent{
 		Announce:     t.Announce,
+		AnnounceList: announceListFromBencode(t),
 		Comment:      t.Comment,
 		CreationDate: t.CreationDate,
 		CreatedBy:    t.CreatedBy,
-		FileSize:     t.Info.Length,
+		FileSize:     totalSize,
 		FileName:     t.Info.Name,
-		PieceSize:    t.Info.PieceLength,
+		MultiFile:    len(t.Info.Files) > 0,
+		Files:        files,
+		PieceSize:    pieceLength,
 		PiecesHashes: pHashes,
 		InfoHash:     infoHash,
+		TotalPieces:  len(pHashes),
+		Private:      t.Info.Private == 1,
 	}, nil
 }
 
 func getTorrentFile(torrentFile *os.File) (*Torrent, error) {
+	data, err := io.ReadAll(torrentFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent file: %w", err)
+	}
+
+	return TorrentFromBytes(data)
+}
+
+func TorrentFromBytes(data []byte) (*Torrent, error) {
 	tData := bencodeTorrent{}
-	if err := bencode.Unmarshal(torrentFile, &tData); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to unmarshal torrent file: %s\n", err.Error())
-		os.Exit(1)
+	if err := bencode.Unmarshal(bytes.NewReader(data), &tData); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal torrent file: %w", err)
 	}
 
-	torrent, err := torrentFromBencode(tData)
+	rawInfo, err := rawDictValue(data, "info")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse torrent information: %s\n", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to get field 'info': %w", err)
 	}
 
-	torrent.TotalPieces = len(torrent.PiecesHashes)
+	torrent, err := torrentFromBencode(tData, rawInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent information: %w", err)
+	}
+	torrent.Nodes = nodesFromBencode(data)
 
 	return torrent, nil
 }
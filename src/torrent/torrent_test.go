@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Info dictionaries with keys the client doesn't know about, which still count for the info hash
+const (
+	singleFileInfo = "d6:lengthi1024e6:md5sum32:0123456789abcdef0123456789abcdef4:name8:file.txt" +
+		"12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1e6:source3:ABCe"
+	multiFileInfo = "d5:filesld6:lengthi20000e6:md5sum32:0123456789abcdef0123456789abcdef4:pathl3:sub5:a.binee" +
+		"d6:lengthi100e4:pathl5:b.txteee4:name3:dir12:piece lengthi16384e" +
+		"6:pieces40:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb6:source5:OTHERe"
+)
+
+func bencodedString(s string) string {
+	return fmt.Sprintf("%d:%s", len(s), s)
+}
+
+func torrentFixture(info string) string {
+	return "d8:announce" + bencodedString("http://tracker.example/announce") +
+		"7:comment" + bencodedString("fixture") +
+		"4:info" + info +
+		"8:url-list" + bencodedString("http://example.com/files") + "e"
+}
+
+func TestInfoHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     string
+		infoHash string
+		private  bool
+	}{
+		{"single file", singleFileInfo, "ee8e731194014f34fc7304739abe37f3ccb62ae6", true},
+		{"multiple files", multiFileInfo, "0f9fc0e612267c8d8058a5f73b234ca3194f1041", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torr, err := TorrentFromBytes([]byte(torrentFixture(tt.info)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := hex.EncodeToString(torr.InfoHash[:]); got != tt.infoHash {
+				t.Fatalf("expected info hash %s, got %s", tt.infoHash, got)
+			}
+			if torr.InfoHash != sha1.Sum([]byte(tt.info)) {
+				t.Fatal("expected the info hash to be calculated over the exact info bytes")
+			}
+			if torr.Private != tt.private {
+				t.Fatalf("expected private to be %t", tt.private)
+			}
+		})
+	}
+}
+
+func TestMultiFileTorrent(t *testing.T) {
+	torr, err := TorrentFromBytes([]byte(torrentFixture(multiFileInfo)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !torr.MultiFile || torr.FileSize != 20100 || torr.TotalPieces != 2 {
+		t.Fatalf("unexpected torrent %+v", torr)
+	}
+	if len(torr.Files) != 2 || torr.Files[1].Path != "b.txt" || torr.Files[1].Offset != 20000 {
+		t.Fatalf("unexpected files %+v", torr.Files)
+	}
+	if !strings.HasSuffix(torr.Files[0].Path, "a.bin") {
+		t.Fatalf("unexpected path %s", torr.Files[0].Path)
+	}
+}
+
+func TestRealTorrentFiles(t *testing.T) {
+	tests := []struct {
+		file     string
+		infoHash string
+		size     uint
+		pieces   int
+	}{
+		// The official Arch Linux ISO torrent, made with mktorrent
+		{"archlinux-2019.12.01-x86_64.iso.torrent", "dee86a7fa6f286a9d74c362014616a0ff5e4843d", 670040064, 1278},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			torr, err := TorrentFromFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := hex.EncodeToString(torr.InfoHash[:]); got != tt.infoHash {
+				t.Fatalf("expected info hash %s, got %s", tt.infoHash, got)
+			}
+			if torr.FileSize != tt.size || torr.TotalPieces != tt.pieces || torr.Private {
+				t.Fatalf("unexpected torrent %s", torr.FileName)
+			}
+		})
+	}
+}
+
+func TestInvalidPieces(t *testing.T) {
+	for name, info := range map[string]string{
+		"zero piece length":     "d6:lengthi1024e4:name8:file.txt12:piece lengthi0e6:pieces20:aaaaaaaaaaaaaaaaaaaae",
+		"negative piece length": "d6:lengthi1024e4:name8:file.txt12:piece lengthi-16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae",
+		"missing piece hash":    "d6:lengthi20000e4:name8:file.txt12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae",
+		"extra piece hash":      "d6:lengthi1024e4:name8:file.txt12:piece lengthi16384e6:pieces40:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaae",
+	} {
+		if _, err := TorrentFromBytes([]byte(torrentFixture(info))); err == nil {
+			t.Fatalf("expected a torrent with %s to be rejected", name)
+		}
+	}
+}